@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+)
+
+// asciiAddress converts the domain part of addr to its ASCII (punycode) form so it can be
+// used in the SMTP envelope, e.g. "user@müller.de" becomes "user@xn--mller-kva.de".
+func asciiAddress(addr string) (string, error) {
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return addr, nil
+	}
+	domain, err := idna.Lookup.ToASCII(addr[at+1:])
+	if err != nil {
+		return "", fmt.Errorf("invalid domain in address %q: %w", addr, err)
+	}
+	return addr[:at+1] + domain, nil
+}
+
+// asciiAddresses applies asciiAddress to every address in addrs.
+func asciiAddresses(addrs []string) ([]string, error) {
+	converted := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		ascii, err := asciiAddress(addr)
+		if err != nil {
+			return nil, err
+		}
+		converted = append(converted, ascii)
+	}
+	return converted, nil
+}
+
+// envelopeSender returns the MAIL FROM address for a message with header From from.
+// envelopeFrom is either a full address, used as is, or a bare domain that replaces the
+// domain of from. An empty envelopeFrom keeps from.
+func envelopeSender(envelopeFrom, from string) string {
+	switch {
+	case envelopeFrom == "":
+		return from
+	case strings.Contains(envelopeFrom, "@"):
+		return envelopeFrom
+	}
+	return from[:strings.LastIndex(from, "@")+1] + envelopeFrom
+}
+
+// checkEnvelopeAlignment validates ENVELOPE_FROM and warns about header From addresses
+// whose organizational domain differs from it. Such mail can pass SPF for the provider's
+// domain yet fail DMARC alignment, leaving DKIM as the only way to pass.
+func checkEnvelopeAlignment(envelopeFrom string, froms []string) error {
+	if envelopeFrom == "" {
+		return nil
+	}
+	domain := envelopeFrom
+	if strings.Contains(envelopeFrom, "@") {
+		if err := validateFrom(envelopeFrom); err != nil {
+			return fmt.Errorf("invalid ENVELOPE_FROM: %w", err)
+		}
+		domain = envelopeFrom[strings.LastIndex(envelopeFrom, "@")+1:]
+	}
+	envelopeOrg, err := publicsuffix.EffectiveTLDPlusOne(strings.ToLower(domain))
+	if err != nil {
+		return fmt.Errorf("invalid ENVELOPE_FROM domain %q: %w", domain, err)
+	}
+
+	for _, from := range froms {
+		fromDomain := strings.ToLower(from[strings.LastIndex(from, "@")+1:])
+		if fromOrg, err := publicsuffix.EffectiveTLDPlusOne(fromDomain); err != nil || fromOrg != envelopeOrg {
+			log.Printf("Warning: envelope sender domain %s is not aligned with header From %s, so SPF won't count towards DMARC and the relay must DKIM-sign as %s", domain, from, fromDomain)
+		}
+	}
+	return nil
+}
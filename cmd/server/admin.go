@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"os"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// apiKeyHeader carries the key for endpoints guarded by requireAPIKey.
+const apiKeyHeader = "X-API-Key"
+
+// requireAPIKey guards operator endpoints with ADMIN_API_KEY. When no key is configured
+// the endpoints are unavailable rather than open.
+func requireAPIKey() fiber.Handler {
+	key := os.Getenv("ADMIN_API_KEY")
+	return func(c *fiber.Ctx) error {
+		if key == "" {
+			return respond(c, fiber.StatusForbidden, fiber.Map{
+				"error": "Admin endpoints are disabled, set ADMIN_API_KEY to enable them",
+			})
+		}
+		if subtle.ConstantTimeCompare([]byte(c.Get(apiKeyHeader)), []byte(key)) != 1 {
+			log.Printf("Rejecting %s %s with missing or invalid %s", c.Method(), c.Path(), apiKeyHeader)
+			return respond(c, fiber.StatusUnauthorized, fiber.Map{
+				"error": "Missing or invalid API key",
+			})
+		}
+		return c.Next()
+	}
+}
+
+// requireAPIKeyWhen applies requireAPIKey to the requests matched by when, passing the
+// rest through untouched.
+func requireAPIKeyWhen(when func(c *fiber.Ctx) bool) fiber.Handler {
+	guard := requireAPIKey()
+	return func(c *fiber.Ctx) error {
+		if !when(c) {
+			return c.Next()
+		}
+		return guard(c)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// fieldAliases maps normalized payload keys to WebhookPayload's field names, so scripts
+// written by different teams work without agreeing on a spelling first. Keys are
+// normalized by lowercasing them and dropping "_", "-" and spaces, which already
+// accepts every casing of a field name, e.g. ExitCode, exit_code and exit-code. On top
+// of that these aliases are accepted:
+//
+//	status:           state, result
+//	timestamp:        time, date, datetime
+//	source:           src, sourcepath
+//	destination:      dest, dst, target, destinationpath
+//	exitCode:         code, rc, returncode, exitstatus
+//	emailContent:     content, body, emailbody, message
+//	emailContentHtml: html, bodyhtml, htmlbody, emailhtml
+//	subject:          title
+//	host:             hostname, computername, machine
+//	jobId:            job, runid
+//	deliverAt:        sendat, scheduledat
+//
+// A field given by its own name wins over an alias for it.
+var fieldAliases = map[string]string{
+	"state": "status", "result": "status",
+	"time": "timestamp", "date": "timestamp", "datetime": "timestamp",
+	"src": "source", "sourcepath": "source",
+	"dest": "destination", "dst": "destination", "target": "destination", "destinationpath": "destination",
+	"code": "exitCode", "rc": "exitCode", "returncode": "exitCode", "exitstatus": "exitCode",
+	"content": "emailContent", "body": "emailContent", "emailbody": "emailContent", "message": "emailContent",
+	"html": "emailContentHtml", "bodyhtml": "emailContentHtml", "htmlbody": "emailContentHtml", "emailhtml": "emailContentHtml",
+	"title":    "subject",
+	"hostname": "host", "computername": "host", "machine": "host",
+	"job": "jobId", "runid": "jobId",
+	"sendat": "deliverAt", "scheduledat": "deliverAt",
+}
+
+func init() {
+	for _, name := range []string{"status", "timestamp", "source", "destination", "exitCode", "emailContent", "emailContentHtml", "subject", "host", "jobId", "event", "deliverAt"} {
+		fieldAliases[normalizeKey(name)] = name
+	}
+}
+
+// normalizeKey folds the spelling differences between payload keys.
+func normalizeKey(key string) string {
+	return strings.ToLower(strings.NewReplacer("_", "", "-", "", " ", "").Replace(key))
+}
+
+// canonicalField returns the WebhookPayload field name key stands for, and whether key
+// is that name exactly rather than an alias. Unknown keys are returned unchanged.
+func canonicalField(key string) (string, bool) {
+	name, ok := fieldAliases[normalizeKey(key)]
+	if !ok {
+		return key, true
+	}
+	return name, name == key
+}
+
+// UnmarshalJSON decodes a payload, accepting the key aliases in fieldAliases.
+func (p *WebhookPayload) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	normalized := make(map[string]json.RawMessage, len(fields))
+	for key, value := range fields {
+		if name, exact := canonicalField(key); exact {
+			normalized[name] = value
+		}
+	}
+	// Sorted so that the alias used when several are given doesn't vary between requests
+	for _, key := range slices.Sorted(maps.Keys(fields)) {
+		if name, exact := canonicalField(key); !exact {
+			if _, ok := normalized[name]; !ok {
+				normalized[name] = fields[key]
+			}
+		}
+	}
+
+	data, err := json.Marshal(normalized)
+	if err != nil {
+		return err
+	}
+	type plain WebhookPayload // Drops this method so decoding doesn't recurse
+	return json.Unmarshal(data, (*plain)(p))
+}
+
+// normalizeFormKeys renames aliased keys in a form-encoded body to their field names
+// before BodyParser reads it.
+func normalizeFormKeys(c *fiber.Ctx) {
+	args := c.Request().PostArgs()
+	type rename struct{ from, to, value string }
+	var renames []rename
+	args.VisitAll(func(key, value []byte) {
+		if name, exact := canonicalField(string(key)); !exact {
+			renames = append(renames, rename{string(key), name, string(value)})
+		}
+	})
+	for _, r := range renames {
+		if !args.Has(r.to) {
+			args.Set(r.to, r.value)
+		}
+		args.Del(r.from)
+	}
+}
+
+// normalizeMultipartKeys renames aliased fields of a multipart/form-data request in
+// place, as normalizeFormKeys does for url-encoded forms.
+func normalizeMultipartKeys(values map[string][]string) {
+	for _, key := range slices.Sorted(maps.Keys(values)) {
+		if name, exact := canonicalField(key); !exact {
+			if _, ok := values[name]; !ok {
+				values[name] = values[key]
+			}
+			delete(values, key)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// attachment is a file sent alongside the text body of a message.
+type attachment struct {
+	Name        string `json:"name"`
+	ContentType string `json:"contentType"`
+	Data        []byte `json:"data"`
+}
+
+// errAttachmentTooLarge is returned by parsePayload for an uploaded file over MAX_ATTACHMENT_SIZE.
+var errAttachmentTooLarge = errors.New("attachment too large")
+
+// maxAttachmentSize caps each uploaded file, in bytes. It is set from MAX_ATTACHMENT_SIZE
+// at startup; the whole request is also capped by SERVER_BODY_LIMIT as it is streamed.
+var maxAttachmentSize int64 = 1 << 20
+
+// loadAttachmentLimit reads MAX_ATTACHMENT_SIZE, defaulting to 1 MiB.
+func loadAttachmentLimit() error {
+	v := os.Getenv("MAX_ATTACHMENT_SIZE")
+	if v == "" {
+		return nil
+	}
+	limit, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || limit <= 0 {
+		return fmt.Errorf("invalid MAX_ATTACHMENT_SIZE %q: must be a positive number of bytes", v)
+	}
+	maxAttachmentSize = limit
+	return nil
+}
+
+// readUploads streams the parts of a multipart/form-data body, returning its form values
+// and, in field name order, its files as attachments keeping the Content-Type of their
+// part. A file is refused as soon as it runs past maxAttachmentSize, without reading the
+// rest of it.
+func readUploads(body io.Reader, boundary string) (map[string][]string, []attachment, error) {
+	values := make(map[string][]string)
+	files := make(map[string][]attachment)
+	mr := multipart.NewReader(body, boundary)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		field := part.FormName()
+		if field == "" {
+			continue
+		}
+		if part.FileName() == "" {
+			value, err := io.ReadAll(part)
+			if err != nil {
+				return nil, nil, fmt.Errorf("reading field %s: %w", field, err)
+			}
+			values[field] = append(values[field], string(value))
+			continue
+		}
+
+		data, err := io.ReadAll(io.LimitReader(part, maxAttachmentSize+1))
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading attachment %s: %w", part.FileName(), err)
+		}
+		if int64(len(data)) > maxAttachmentSize {
+			return nil, nil, fmt.Errorf("%w: %s is over the limit of %d bytes", errAttachmentTooLarge, part.FileName(), maxAttachmentSize)
+		}
+		files[field] = append(files[field], attachment{
+			Name:        attachmentName(part.FileName(), field),
+			ContentType: attachmentType(part.Header.Get("Content-Type")),
+			Data:        data,
+		})
+	}
+	// Read past the closing boundary too, so a signature over the whole body is checked
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		return nil, nil, err
+	}
+
+	var attachments []attachment
+	for _, field := range slices.Sorted(maps.Keys(files)) {
+		attachments = append(attachments, files[field]...)
+	}
+	return values, attachments, nil
+}
+
+// attachmentName strips any directories and quotes from an uploaded file name, so it
+// can't break out of the quoted header parameter it is written into.
+func attachmentName(filename, field string) string {
+	name := strings.Map(func(r rune) rune {
+		if r == '"' || r == '\\' || r < ' ' {
+			return -1
+		}
+		return r
+	}, filepath.Base(strings.ReplaceAll(filename, "\\", "/")))
+	if name == "" || name == "." || name == "/" {
+		return field
+	}
+	return name
+}
+
+// attachmentType returns the media type of an uploaded part without its parameters,
+// defaulting to application/octet-stream.
+func attachmentType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	return mediaType
+}
+
+// exitCodeFlags names the robocopy exit code bits, lowest first.
+var exitCodeFlags = []struct {
+	bit  int
+	name string
+}{
+	{1, "filesCopied"},
+	{2, "extraFiles"},
+	{4, "mismatched"},
+	{8, "copyFailures"},
+	{16, "fatalError"},
+}
+
+// statusAttachment describes the decoded outcome of payload as status.json, so that
+// recipients' automation can read it without parsing the body.
+func statusAttachment(payload *WebhookPayload) (attachment, error) {
+	flags := []string{}
+	for _, flag := range exitCodeFlags {
+		if payload.ExitCode&flag.bit != 0 {
+			flags = append(flags, flag.name)
+		}
+	}
+	data, err := json.MarshalIndent(map[string]any{
+		"status":      payload.Status,
+		"exitCode":    payload.ExitCode,
+		"flags":       flags,
+		"severity":    payloadSeverity(payload).String(),
+		"source":      payload.Source,
+		"destination": payload.Destination,
+		"timestamp":   payload.Timestamp,
+		"host":        payload.hostname(),
+		"jobId":       payload.JobID,
+	}, "", "  ")
+	if err != nil {
+		return attachment{}, err
+	}
+	return attachment{Name: "status.json", ContentType: "application/json", Data: data}, nil
+}
+
+// writeMixed renders a multipart/mixed entity, headers included, holding the rendered
+// text part followed by attachments.
+func writeMixed(b *bytes.Buffer, text []byte, attachments []attachment) {
+	var random [16]byte
+	rand.Read(random[:])
+	boundary := "mixed-" + hex.EncodeToString(random[:])
+
+	b.WriteString("Content-Type: multipart/mixed; boundary=\"" + boundary + "\"\r\n" +
+		"\r\n" +
+		"--" + boundary + "\r\n")
+	b.Write(text)
+	for _, a := range attachments {
+		name := mime.QEncoding.Encode("UTF-8", a.Name)
+		b.WriteString("\r\n--" + boundary + "\r\n" +
+			"Content-Type: " + a.ContentType + "; name=\"" + name + "\"\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"Content-Disposition: attachment; filename=\"" + name + "\"\r\n" +
+			"\r\n")
+		// Encode straight into the message rather than through a second copy of the file
+		enc := base64.NewEncoder(base64.StdEncoding, &lineBreaker{w: b})
+		enc.Write(a.Data)
+		enc.Close()
+	}
+	b.WriteString("\r\n--" + boundary + "--\r\n")
+}
+
+// lineBreaker writes to w, starting a new line every maxPlainLineLength bytes.
+type lineBreaker struct {
+	w      *bytes.Buffer
+	column int
+}
+
+func (l *lineBreaker) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if l.column == maxPlainLineLength {
+			l.w.WriteString("\r\n")
+			l.column = 0
+		}
+		chunk := min(len(p), maxPlainLineLength-l.column)
+		l.w.Write(p[:chunk])
+		l.column += chunk
+		p = p[chunk:]
+	}
+	return n, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestWriteMixedAttachmentEncoding(t *testing.T) {
+	for _, size := range []int{0, 1, 56, 57, 58, 1000} {
+		data := bytes.Repeat([]byte{0xde, 0xad, 0xbe, 0xef}, size)[:size]
+		var b bytes.Buffer
+		writeMixed(&b, []byte("Content-Type: text/plain\r\n\r\nHello\r\n"), []attachment{{Name: "log.bin", ContentType: "application/octet-stream", Data: data}})
+
+		_, rest, _ := strings.Cut(b.String(), "Content-Disposition: attachment; filename=\"log.bin\"\r\n\r\n")
+		encoded, _, ok := strings.Cut(rest, "\r\n--mixed-")
+		if !ok {
+			t.Fatalf("%d bytes: attachment part not terminated:\n%s", size, b.String())
+		}
+		for _, line := range strings.Split(encoded, "\r\n") {
+			if len(line) > maxPlainLineLength {
+				t.Errorf("%d bytes: line of %d characters", size, len(line))
+			}
+		}
+		decoded, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(encoded, "\r\n", ""))
+		if err != nil || !bytes.Equal(decoded, data) {
+			t.Errorf("%d bytes: attachment did not survive encoding: %v", size, err)
+		}
+	}
+}
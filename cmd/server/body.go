@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// errBodyTooLarge is returned while reading a request body past SERVER_BODY_LIMIT.
+var errBodyTooLarge = errors.New("request body too large")
+
+// uploadBodyKey is the Locals key under which limitRequestBody leaves a streamed upload.
+const uploadBodyKey = "uploadBody"
+
+// limitRequestBody reads request bodies into memory within SERVER_BODY_LIMIT. The server
+// streams request bodies, so fasthttp no longer refuses large ones itself. Uploads, the
+// multipart/form-data bodies posted to uploadPaths, are left unread for parsePayload to
+// stream part by part, still within the limit.
+func limitRequestBody(uploadPaths ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		req := c.Request()
+		if !req.IsBodyStream() {
+			return c.Next()
+		}
+		body := &limitedBody{r: req.BodyStream(), left: int64(c.App().Config().BodyLimit)}
+
+		path := strings.TrimSuffix(c.Path(), "/")
+		upload := slices.ContainsFunc(uploadPaths, func(p string) bool { return strings.EqualFold(p, path) })
+		if upload && strings.HasPrefix(strings.ToLower(c.Get(fiber.HeaderContentType)), fiber.MIMEMultipartForm) {
+			c.Locals(uploadBodyKey, io.Reader(body))
+			err := c.Next()
+			// Whatever the handler left unread would be taken for the next request
+			if !body.done {
+				c.Context().SetConnectionClose()
+			}
+			return err
+		}
+
+		data, err := io.ReadAll(body)
+		if errors.Is(err, errBodyTooLarge) {
+			c.Context().SetConnectionClose()
+			return respond(c, fiber.StatusRequestEntityTooLarge, fiber.Map{
+				"error": "Request body too large",
+			})
+		}
+		if err != nil {
+			return err
+		}
+		req.SetBodyRaw(data)
+		return c.Next()
+	}
+}
+
+// uploadBody returns the body of a multipart/form-data request, as limitRequestBody left
+// it to be streamed or, when the server read it in full, from memory.
+func uploadBody(c *fiber.Ctx) io.Reader {
+	if body, ok := c.Locals(uploadBodyKey).(io.Reader); ok {
+		return body
+	}
+	return bytes.NewReader(c.Body())
+}
+
+// limitedBody reads a request body, failing with errBodyTooLarge once more than left
+// bytes have been read.
+type limitedBody struct {
+	r    io.Reader
+	left int64
+	done bool // Read to the end; r isn't read again, since a chunked stream would read on into the next request
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.done {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > l.left+1 {
+		p = p[:l.left+1]
+	}
+	n, err := l.r.Read(p)
+	if int64(n) > l.left {
+		n, l.left = int(l.left), 0
+		return n, errBodyTooLarge
+	}
+	l.left -= int64(n)
+	if err == io.EOF {
+		l.done = true
+	}
+	return n, err
+}
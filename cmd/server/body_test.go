@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// newUploadServer serves n's routes, behind chain, on a loopback port with the server
+// settings of loadServerConfig, which stream request bodies.
+func newUploadServer(t *testing.T, n *notifier, chain []fiber.Handler) string {
+	t.Helper()
+	cfg, err := loadServerConfig()
+	if err != nil {
+		t.Fatalf("loadServerConfig: %v", err)
+	}
+	cfg.DisableStartupMessage = true
+	app := fiber.New(cfg.Config)
+	registerRoutes(app, n, chain, chain)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	go app.Listener(ln)
+	t.Cleanup(func() {
+		// Shutdown waits out keep-alive connections otherwise
+		http.DefaultClient.CloseIdleConnections()
+		app.Shutdown()
+	})
+	return "http://" + ln.Addr().String()
+}
+
+// uploadBodyParts returns a multipart/form-data body, split around the content of its one
+// file so a test can supply that content however it likes.
+func uploadBodyParts(t *testing.T) (contentType string, head, tail []byte) {
+	t.Helper()
+	var b bytes.Buffer
+	w := multipart.NewWriter(&b)
+	w.WriteField("status", "Failed")
+	w.WriteField("exitCode", "8")
+	w.WriteField("emailContent", "Robocopy output")
+	if _, err := w.CreateFormFile("log", "robocopy.log"); err != nil {
+		t.Fatalf("CreateFormFile: %v", err)
+	}
+	head = bytes.Clone(b.Bytes())
+	b.Reset()
+	w.Close()
+	return w.FormDataContentType(), head, bytes.Clone(b.Bytes())
+}
+
+// countingReader produces n bytes, counting how many were read.
+type countingReader struct {
+	n, read int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	if r.read == r.n {
+		return 0, io.EOF
+	}
+	p = p[:min(len(p), r.n-r.read)]
+	for i := range p {
+		p[i] = 'a'
+	}
+	r.read += len(p)
+	return len(p), nil
+}
+
+// post sends body to url, returning the response status, or 0 when the server hung up
+// before answering.
+func post(t *testing.T, url, contentType string, body io.Reader, headers ...string) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url, body)
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Logf("POST %s: %v", url, err)
+		return 0
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestUploadStreaming(t *testing.T) {
+	t.Setenv("SERVER_BODY_LIMIT", "1073741824")
+	limit := maxAttachmentSize
+	maxAttachmentSize = 1024
+	t.Cleanup(func() { maxAttachmentSize = limit })
+
+	n, capture := newTestNotifier()
+	url := newUploadServer(t, n, nil) + "/webhook/robocopy-failure"
+	contentType, head, tail := uploadBodyParts(t)
+
+	t.Run("within limit", func(t *testing.T) {
+		file := &countingReader{n: 1000}
+		if status := post(t, url, contentType, io.MultiReader(bytes.NewReader(head), file, bytes.NewReader(tail))); status != fiber.StatusOK {
+			t.Fatalf("status = %d, want 200", status)
+		}
+		if len(capture.messages) != 1 || !strings.Contains(capture.messages[0].MIME, `filename="robocopy.log"`) {
+			t.Fatalf("the upload wasn't attached: %v", capture.messages)
+		}
+	})
+
+	t.Run("over attachment limit", func(t *testing.T) {
+		file := &countingReader{n: 1 << 30}
+		// Hanging up on the rest of the upload may reset the connection before the client reads the 413
+		if status := post(t, url, contentType, io.MultiReader(bytes.NewReader(head), file, bytes.NewReader(tail))); status != fiber.StatusRequestEntityTooLarge && status != 0 {
+			t.Fatalf("status = %d, want 413", status)
+		}
+		if len(capture.messages) != 1 {
+			t.Errorf("sent %d messages, want only the first upload's", len(capture.messages))
+		}
+		// What was sent beyond the limit is what fit in the socket buffers when the server hung up
+		if file.read > 64<<20 {
+			t.Errorf("the server received %d bytes of a file limited to %d", file.read, maxAttachmentSize)
+		}
+	})
+}
+
+func TestBodyLimitWhileStreaming(t *testing.T) {
+	t.Setenv("SERVER_BODY_LIMIT", "4096")
+	n, capture := newTestNotifier()
+	base := newUploadServer(t, n, nil)
+
+	payload := `{"status":"Failed","exitCode":8,"emailContent":"` + strings.Repeat("a", 5000) + `"}`
+	if status := post(t, base+"/webhook/robocopy-failure", fiber.MIMEApplicationJSON, strings.NewReader(payload)); status != fiber.StatusRequestEntityTooLarge {
+		t.Errorf("JSON over the limit: status = %d, want 413", status)
+	}
+
+	contentType, head, tail := uploadBodyParts(t)
+	file := &countingReader{n: 5000}
+	if status := post(t, base+"/webhook/robocopy-failure", contentType, io.MultiReader(bytes.NewReader(head), file, bytes.NewReader(tail))); status != fiber.StatusRequestEntityTooLarge {
+		t.Errorf("upload over the limit: status = %d, want 413", status)
+	}
+	if len(capture.messages) != 0 {
+		t.Errorf("sent %d messages, want none", len(capture.messages))
+	}
+}
+
+func TestStreamedUploadSignature(t *testing.T) {
+	t.Setenv("WEBHOOK_SECRET", "secret")
+	signature, err := newSignatureMiddleware()
+	if err != nil {
+		t.Fatalf("newSignatureMiddleware: %v", err)
+	}
+	n, capture := newTestNotifier()
+	url := newUploadServer(t, n, []fiber.Handler{signature}) + "/webhook/robocopy-failure"
+
+	contentType, head, tail := uploadBodyParts(t)
+	body := append(append(head, "log line\r\n"...), tail...)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(body)
+	valid := hex.EncodeToString(mac.Sum(nil))
+
+	if status := post(t, url, contentType, bytes.NewReader(body), "X-Signature", valid); status != fiber.StatusOK {
+		t.Errorf("valid signature: status = %d, want 200", status)
+	}
+	tampered := bytes.Replace(body, []byte("log line"), []byte("log LINE"), 1)
+	if status := post(t, url, contentType, bytes.NewReader(tampered), "X-Signature", valid); status != fiber.StatusUnauthorized {
+		t.Errorf("tampered upload: status = %d, want 401", status)
+	}
+	if len(capture.messages) != 1 {
+		t.Errorf("sent %d messages, want only the valid upload's", len(capture.messages))
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Exit codes of -send mode.
+const (
+	exitSent     = 0
+	exitFailed   = 1 // The relay or a hook refused the email
+	exitRejected = 2 // The email was invalid, e.g. a recipient outside the allowed domains
+)
+
+// sendOnce delivers a single email with the same policies as the webhook, prints the
+// result as JSON and returns the process exit code. A body of "-" is read from stdin.
+func sendOnce(n *notifier, to []string, subject, body string) int {
+	if body == "-" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading body from stdin: %v\n", err)
+			return exitRejected
+		}
+		body = string(data)
+	}
+	if len(to) == 0 {
+		to = n.mail.To
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	r := n.deliver(ctx, identity{From: n.mail.From}, to, subject, emailBody{text: body})
+
+	out, _ := json.Marshal(r.body)
+	fmt.Println(string(out))
+	switch {
+	case r.status < fiber.StatusBadRequest:
+		return exitSent
+	case r.status < fiber.StatusInternalServerError && r.status != fiber.StatusForbidden:
+		return exitRejected
+	default:
+		return exitFailed
+	}
+}
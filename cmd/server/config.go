@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// errRecipientNotAllowed is returned when a recipient's domain isn't in ALLOWED_RECIPIENT_DOMAINS.
+var errRecipientNotAllowed = errors.New("recipient domain not allowed")
+
+// errTooManyRecipients is returned when a message has more than MAX_RECIPIENTS recipients.
+var errTooManyRecipients = errors.New("too many recipients")
+
+// mailConfig holds the addressing settings applied to every outgoing message.
+type mailConfig struct {
+	From           string
+	To             []string
+	Routes         map[severity][]string // Recipients per severity, overriding To
+	AllowedDomains []string              // Empty means any recipient domain is allowed
+	Footer         string                // Appended to every message body
+	MaxBodyLen     int                   // Bodies longer than this many bytes are truncated; zero means no limit
+	AttachFullBody bool                  // Attach a body over MaxBodyLen in full as body.txt, as well as truncating it
+	MaxRecipients  int                   // Messages with more recipients are refused; zero means no limit
+	Suppressed     *suppressionList
+	Manage         *manageLinks  // Per-recipient opt-out links for heartbeats and digests
+	SenderRoutes   []senderRoute // Alternative From addresses chosen per payload
+	BccSender      bool          // Send a blind copy of every message to its From address
+}
+
+// loadMailConfig reads the addressing settings from the environment.
+func loadMailConfig() (mailConfig, error) {
+	cfg := mailConfig{
+		From:           os.Getenv("SENDER_EMAIL"),
+		To:             splitList(os.Getenv("RECIPIENT_EMAIL")),
+		AllowedDomains: splitList(strings.ToLower(os.Getenv("ALLOWED_RECIPIENT_DOMAINS"))),
+		Footer:         os.Getenv("BODY_FOOTER"),
+		Routes:         make(map[severity][]string),
+		BccSender:      os.Getenv("BCC_SENDER") == "true",
+		AttachFullBody: os.Getenv("MAX_BODY_ATTACH") == "true",
+	}
+	for _, sev := range severities {
+		if to := splitList(os.Getenv("RECIPIENTS_" + strings.ToUpper(sev.String()))); len(to) > 0 {
+			cfg.Routes[sev] = to
+		}
+	}
+	if cfg.From == "" || len(cfg.To) == 0 {
+		return mailConfig{}, fmt.Errorf("email addresses missing in .env or environment variables. Please check SENDER_EMAIL, RECIPIENT_EMAIL")
+	}
+	if err := validateFrom(cfg.From); err != nil {
+		return mailConfig{}, fmt.Errorf("invalid SENDER_EMAIL: %w", err)
+	}
+	if v := os.Getenv("MAX_BODY_LEN"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			return mailConfig{}, fmt.Errorf("invalid MAX_BODY_LEN %q: must be a non-negative integer", v)
+		}
+		cfg.MaxBodyLen = limit
+	}
+	if v := os.Getenv("MAX_RECIPIENTS"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			return mailConfig{}, fmt.Errorf("invalid MAX_RECIPIENTS %q: must be a non-negative integer", v)
+		}
+		cfg.MaxRecipients = limit
+	}
+	// A configured list over the limit would have every notification refused
+	lists := map[string][]string{"RECIPIENT_EMAIL": cfg.To}
+	for sev, to := range cfg.Routes {
+		lists["RECIPIENTS_"+strings.ToUpper(sev.String())] = to
+	}
+	for name, to := range lists {
+		if cfg.MaxRecipients > 0 && len(to) > cfg.MaxRecipients {
+			return mailConfig{}, fmt.Errorf("%s has %d recipients, more than MAX_RECIPIENTS (%d)", name, len(to), cfg.MaxRecipients)
+		}
+	}
+
+	routes, err := loadSenderRoutes()
+	if err != nil {
+		return mailConfig{}, err
+	}
+	cfg.SenderRoutes = routes
+
+	if path := os.Getenv("SUPPRESSION_FILE"); path != "" {
+		list, err := loadSuppressionList(path)
+		if err != nil {
+			return mailConfig{}, err
+		}
+		cfg.Suppressed = list
+	}
+	if cfg.Manage, err = loadManageLinks(cfg.Suppressed); err != nil {
+		return mailConfig{}, err
+	}
+	return cfg, nil
+}
+
+// recipientsFor returns the recipients for a notification of the given severity,
+// falling back to the default recipients when no route is configured for it.
+func (m mailConfig) recipientsFor(sev severity) []string {
+	if to, ok := m.Routes[sev]; ok {
+		return to
+	}
+	return m.To
+}
+
+// checkRecipients returns errTooManyRecipients if addrs exceeds MaxRecipients and
+// errRecipientNotAllowed if any address falls outside the allowed domains.
+func (m mailConfig) checkRecipients(addrs []string) error {
+	if m.MaxRecipients > 0 && len(addrs) > m.MaxRecipients {
+		return fmt.Errorf("%w: %d, the limit is %d", errTooManyRecipients, len(addrs), m.MaxRecipients)
+	}
+	if len(m.AllowedDomains) == 0 {
+		return nil
+	}
+	for _, addr := range addrs {
+		domain := strings.ToLower(addr[strings.LastIndex(addr, "@")+1:])
+		allowed := false
+		for _, d := range m.AllowedDomains {
+			if domain == d {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("%w: %s", errRecipientNotAllowed, addr)
+		}
+	}
+	return nil
+}
+
+// withFooter appends the configured footer, followed by any extra lines, to body as an
+// email signature block.
+func (m mailConfig) withFooter(body string, extra ...string) string {
+	var lines []string
+	if m.Footer != "" {
+		lines = append(lines, m.Footer)
+	}
+	lines = append(lines, extra...)
+	if len(lines) == 0 {
+		return body
+	}
+	return strings.TrimRight(body, "\r\n") + "\r\n\r\n-- \r\n" + strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// withManageLinks appends the footer to msg's text body. When manageable and management
+// links are enabled, msg is split into one copy per recipient, each with their own link.
+func (m mailConfig) withManageLinks(msg Message, manageable bool) []Message {
+	if msg.Body == "" {
+		return []Message{msg}
+	}
+	if !manageable || m.Manage == nil {
+		msg.Body = m.withFooter(msg.Body)
+		return []Message{msg}
+	}
+
+	copies := make([]Message, len(msg.To))
+	for i, rcpt := range msg.To {
+		copies[i] = msg
+		copies[i].To = []string{rcpt}
+		copies[i].Body = m.withFooter(msg.Body, "Manage these notifications: "+m.Manage.url(rcpt))
+		if i > 0 {
+			copies[i].Bcc = nil // The sender needs only one copy
+		}
+	}
+	return copies
+}
+
+// truncated shortens body to MaxBodyLen bytes, marker included, without splitting a
+// UTF-8 sequence, so oversized logs don't get the whole message rejected by the relay.
+// With AttachFullBody the whole body is also returned, as body.txt, for the marker to
+// point to; otherwise the attachment is nil.
+func (m mailConfig) truncated(body string) (string, *attachment) {
+	if m.MaxBodyLen == 0 || len(body) <= m.MaxBodyLen {
+		return body, nil
+	}
+	var full *attachment
+	marker := fmt.Sprintf("\r\n\r\n[truncated, original body was %d bytes]\r\n", len(body))
+	if m.AttachFullBody {
+		full = &attachment{Name: "body.txt", ContentType: "text/plain; charset=utf-8", Data: []byte(body)}
+		marker = fmt.Sprintf("\r\n\r\n[truncated, the original body of %d bytes is attached as body.txt]\r\n", len(body))
+	}
+	keep := max(m.MaxBodyLen-len(marker), 0)
+	for keep > 0 && !utf8.RuneStart(body[keep]) {
+		keep--
+	}
+	return body[:keep] + marker, full
+}
+
+// parsePort parses a TCP port setting, requiring it to be in 1-65535.
+func parsePort(name, value string) (int, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: must be a number", name, value)
+	}
+	if port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid %s %d: must be between 1 and 65535", name, port)
+	}
+	return port, nil
+}
+
+// splitList splits a comma-separated setting, dropping empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
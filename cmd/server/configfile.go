@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fileSetting is where in the -config file a setting was taken from.
+type fileSetting struct {
+	file string
+	key  string // Dotted path of the key in the file
+	line int
+}
+
+// fileSettings records the settings taken from the -config file, for GET /config and for
+// inConfigFile.
+var fileSettings = make(map[string]fileSetting)
+
+// loadConfigFile applies the settings in the YAML file at path to the environment,
+// leaving alone any variable that is already set so the environment (and .env) wins.
+//
+// Keys are the setting names, either flat or nested in sections that are joined with
+// underscores, so these are the same:
+//
+//	SMTP_HOST: smtp.example.com
+//	smtp:
+//	  host: smtp.example.com
+//
+// Lists are joined with commas. The whole file is validated before anything is applied,
+// and errors name the offending key by its path in the file.
+func loadConfigFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil
+	}
+
+	known := make(map[string]bool, len(knownSettings))
+	for _, s := range knownSettings {
+		known[s.name] = true
+	}
+	values := make(map[string]string)
+	sources := make(map[string]fileSetting)
+	if err := collectSettings(doc.Content[0], "", "", known, values, sources); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	for name, value := range values {
+		if _, set := os.LookupEnv(name); set {
+			continue
+		}
+		os.Setenv(name, value)
+		source := sources[name]
+		source.file = path
+		fileSettings[name] = source
+	}
+	return nil
+}
+
+// inConfigFile points an error about an invalid setting at the key of the -config file
+// the setting came from, since the loaders only know settings by their names. Errors
+// about settings that didn't come from the file are returned as they are.
+func inConfigFile(err error) error {
+	if err == nil || len(fileSettings) == 0 {
+		return err
+	}
+	msg := err.Error()
+	first, firstAt := "", len(msg)
+	for name := range fileSettings {
+		if at := settingIndex(msg, name); at >= 0 && at < firstAt {
+			first, firstAt = name, at
+		}
+	}
+	if first == "" {
+		return err
+	}
+	source := fileSettings[first]
+	return fmt.Errorf("%s: line %d: %s: %w", source.file, source.line, source.key, err)
+}
+
+// settingIndex returns the index of the first mention of the setting name in msg, or -1.
+// A name inside a longer one, like PORT in SMTP_PORT, doesn't count.
+func settingIndex(msg, name string) int {
+	isNameChar := func(b byte) bool { return b == '_' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9' }
+	for from := 0; ; {
+		at := strings.Index(msg[from:], name)
+		if at < 0 {
+			return -1
+		}
+		at += from
+		end := at + len(name)
+		if (at == 0 || !isNameChar(msg[at-1])) && (end == len(msg) || !isNameChar(msg[end])) {
+			return at
+		}
+		from = at + 1
+	}
+}
+
+// collectSettings walks the mapping node, adding every setting below it to values.
+// keyPath is the dotted path of node in the file and prefix the setting name it stands for.
+func collectSettings(node *yaml.Node, keyPath, prefix string, known map[string]bool, values map[string]string, sources map[string]fileSetting) error {
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: %s must be a mapping of settings", node.Line, displayPath(keyPath))
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		path := key.Value
+		if keyPath != "" {
+			path = keyPath + "." + key.Value
+		}
+		name := strings.ToUpper(strings.ReplaceAll(key.Value, "-", "_"))
+		if prefix != "" {
+			name = prefix + "_" + name
+		}
+
+		switch value.Kind {
+		case yaml.MappingNode:
+			if err := collectSettings(value, path, name, known, values, sources); err != nil {
+				return err
+			}
+			continue
+		case yaml.SequenceNode:
+			items := make([]string, 0, len(value.Content))
+			for _, item := range value.Content {
+				if item.Kind != yaml.ScalarNode {
+					return fmt.Errorf("line %d: %s: list items must be plain values", item.Line, path)
+				}
+				items = append(items, item.Value)
+			}
+			values[name] = strings.Join(items, ",")
+		case yaml.ScalarNode:
+			values[name] = value.Value
+		default:
+			return fmt.Errorf("line %d: %s: unsupported value", value.Line, path)
+		}
+		if !known[name] {
+			return fmt.Errorf("line %d: %s: unknown setting %s", key.Line, path, name)
+		}
+		sources[name] = fileSetting{key: path, line: key.Line}
+	}
+	return nil
+}
+
+// displayPath names the document root when path is empty.
+func displayPath(path string) string {
+	if path == "" {
+		return "the document"
+	}
+	return path
+}
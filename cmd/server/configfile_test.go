@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// withConfigFile applies the YAML in config as the -config file, undoing its settings
+// when the test ends.
+func withConfigFile(t *testing.T, config string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for name := range fileSettings {
+			os.Unsetenv(name)
+		}
+		clear(fileSettings)
+	})
+	if err := loadConfigFile(path); err != nil {
+		t.Fatalf("loadConfigFile: %v", err)
+	}
+	return path
+}
+
+func TestInConfigFileNamesTheKey(t *testing.T) {
+	for _, name := range []string{"SMTP_HOST", "SMTP_PORT", "SMTP_USERNAME", "SMTP_PASSWORD", "PORT"} {
+		if value, ok := os.LookupEnv(name); ok {
+			os.Unsetenv(name)
+			t.Cleanup(func() { os.Setenv(name, value) })
+		}
+	}
+	path := withConfigFile(t, "smtp:\n  host: smtp.example.com\n  port: 0\n  username: user\n  password: secret\nport: 3000\n")
+
+	_, err := newSMTPSenderFromEnv()
+	if err == nil {
+		t.Fatal("newSMTPSenderFromEnv accepted SMTP_PORT 0")
+	}
+	got := inConfigFile(err).Error()
+	if want := path + ": line 3: smtp.port: invalid SMTP_PORT"; !strings.HasPrefix(got, want) {
+		t.Errorf("error = %q, want it to start with %q", got, want)
+	}
+}
+
+func TestInConfigFileLeavesOtherErrors(t *testing.T) {
+	withConfigFile(t, "port: 3000\n")
+	for _, msg := range []string{`invalid SMTP_PORT "0": must be between 1 and 65535`, "connection refused"} {
+		if got := inConfigFile(errors.New(msg)).Error(); got != msg {
+			t.Errorf("error = %q, want %q unchanged", got, msg)
+		}
+	}
+}
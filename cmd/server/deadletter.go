@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// deadLetter is a notification accepted with ALWAYS_ACCEPT whose background send failed.
+type deadLetter struct {
+	Payload  *WebhookPayload `json:"payload"` // As received, so it can be posted to the webhook again
+	Status   int             `json:"status"`
+	Error    fiber.Map       `json:"error"`
+	FailedAt time.Time       `json:"failedAt"`
+}
+
+// deadLetters keeps failed background sends in a JSON Lines file, one notification per
+// line, so operators can find and resend them. A nil *deadLetters keeps nothing.
+type deadLetters struct {
+	path string
+	mu   sync.Mutex
+}
+
+// loadDeadLetters reads DEAD_LETTER_FILE, defaulting to dead-letter.jsonl.
+func loadDeadLetters() *deadLetters {
+	path := os.Getenv("DEAD_LETTER_FILE")
+	if path == "" {
+		path = "dead-letter.jsonl"
+	}
+	return &deadLetters{path: path}
+}
+
+// add appends the failed notification payload, answered with r, to the file. Uploaded
+// attachments aren't kept.
+func (d *deadLetters) add(payload *WebhookPayload, r result) error {
+	if d == nil {
+		return nil
+	}
+	line, err := json.Marshal(deadLetter{Payload: payload, Status: r.status, Error: r.body, FailedAt: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	f, err := os.OpenFile(d.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", d.path, err)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("writing %s: %w", d.path, err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// debugRequested reports whether a webhook request asked for ?debug=true, which renders
+// the email instead of sending it.
+func debugRequested(c *fiber.Ctx) bool {
+	return c.QueryBool("debug")
+}
+
+// renderedMessage is an email as it would have been handed to the relay.
+type renderedMessage struct {
+	From       string   `json:"from"`
+	Recipients []string `json:"recipients"` // Envelope recipients, Bcc included
+	Relay      string   `json:"relay,omitempty"`
+	MIME       string   `json:"mime"`
+}
+
+// captureSender renders messages with builder and keeps them instead of sending.
+type captureSender struct {
+	builder *messageBuilder
+
+	mu       sync.Mutex
+	messages []renderedMessage
+}
+
+// Send renders msg and records it.
+func (s *captureSender) Send(_ context.Context, msg Message) error {
+	data, err := s.builder.build(msg)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, renderedMessage{From: msg.From, Recipients: msg.envelopeRecipients(), Relay: msg.Relay, MIME: string(data)})
+	return nil
+}
+
+// senderBuilder returns the message builder of sender, so debug output matches what it
+// would send.
+func senderBuilder(sender Sender) (*messageBuilder, error) {
+	switch s := sender.(type) {
+	case *SMTPSender:
+		return s.Builder, nil
+	case *SendmailSender:
+		return s.Builder, nil
+	}
+	return loadMessageBuilder()
+}
+
+// debug runs payload through notify with a sender that only renders, and answers with
+// the rendered messages and the routing decisions behind them. Anything with effects
+// outside this request is left out and reported instead: pre-send hook, PagerDuty,
+// events, job collection, quiet hours, scheduling, threading and stats.
+func (n *notifier) debug(c *fiber.Ctx, payload *WebhookPayload) error {
+	builder, err := senderBuilder(n.sender)
+	if err != nil {
+		return respond(c, fiber.StatusInternalServerError, fiber.Map{
+			"error":   "Failed to load the message builder",
+			"details": err.Error(),
+		})
+	}
+	capture := &captureSender{builder: builder}
+
+	dry := *n
+	dry.sender = capture
+	dry.presend, dry.pager, dry.events = nil, nil, nil
+	dry.jobs, dry.quiet, dry.schedule = nil, nil, nil
+	dry.threads, dry.errors, dry.queue = nil, nil, nil
+	dry.dryRun = true
+	decisions := n.decisions(payload)
+	r := dry.notify(c.UserContext(), payload)
+
+	return respond(c, fiber.StatusOK, fiber.Map{
+		"debug":     true,
+		"status":    r.status,
+		"result":    r.body,
+		"messages":  capture.messages,
+		"decisions": decisions,
+		"requestId": requestID(c),
+	})
+}
+
+// decisions describes how payload is routed and what a real request would do that a
+// debug request skips, going by the payload as the transform rules leave it.
+func (n *notifier) decisions(payload *WebhookPayload) []string {
+	transformed := payload.clone()
+	if _, err := applyTransforms(n.transforms, transformed, ""); err == nil {
+		payload = transformed
+	}
+	sev := payloadSeverity(payload)
+	var d []string
+	d = append(d, fmt.Sprintf("severity %s, from exit code %d and status %q", sev, payload.ExitCode, payload.Status))
+
+	if to, ok := n.mail.Routes[sev]; ok {
+		d = append(d, fmt.Sprintf("recipients from RECIPIENTS_%s: %s", strings.ToUpper(sev.String()), strings.Join(to, ", ")))
+	} else {
+		d = append(d, "recipients from RECIPIENT_EMAIL: "+strings.Join(n.mail.To, ", "))
+	}
+	id := n.mail.identityFor(payload)
+	if id.From != n.mail.From || id.Relay != "" {
+		d = append(d, fmt.Sprintf("sender route matched: from %s, relay %q", id.From, id.Relay))
+	}
+
+	switch {
+	case strings.TrimSpace(payload.Subject) != "":
+		d = append(d, "subject from the payload's subject field")
+	case n.subjectTemplate != nil:
+		d = append(d, "subject from SUBJECT_TEMPLATE")
+	default:
+		d = append(d, "subject from the Subject line in emailContent, or the default subject")
+	}
+
+	if n.successes.suppressed(payload) {
+		d = append(d, "success notifications are suppressed, no email would be sent")
+	}
+	if n.jobs != nil && payload.JobID != "" {
+		d = append(d, "would be held for the summary of job "+payload.JobID+"; rendered as a single notification here")
+	}
+	if at, err := n.schedule.deliverAt(payload); err == nil && at.After(time.Now()) {
+		d = append(d, "would be held until deliverAt "+at.Format(time.RFC3339))
+	}
+	if sev < severityFatal && n.quiet.active(time.Now()) {
+		d = append(d, "quiet hours are active, would be deferred until they end")
+	}
+	if n.presend != nil {
+		d = append(d, "pre-send hook not consulted")
+	}
+	if n.pager != nil && sev >= severityFatal {
+		d = append(d, "would trigger a PagerDuty incident")
+	}
+	if n.threads != nil && payload.JobID != "" {
+		d = append(d, "threading headers with earlier emails of job "+payload.JobID+" are left out")
+	}
+	return d
+}
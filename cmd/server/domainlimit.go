@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// domainLimiter caps the number of concurrent SMTP connections carrying mail for any one
+// recipient domain, so bursts don't trip rate-based blocks at large providers.
+// A nil *domainLimiter imposes no limit.
+type domainLimiter struct {
+	defaultLimit int            // Zero means unlimited
+	overrides    map[string]int // Per-domain limits, taking precedence over defaultLimit
+
+	mu    sync.Mutex
+	slots map[string]chan struct{}
+}
+
+// loadDomainLimiter reads DOMAIN_CONCURRENCY and DOMAIN_CONCURRENCY_OVERRIDES, a
+// comma-separated list such as "gmail.com=2,outlook.com=4". It returns nil when no
+// limit is configured.
+func loadDomainLimiter() (*domainLimiter, error) {
+	l := &domainLimiter{overrides: make(map[string]int), slots: make(map[string]chan struct{})}
+	if v := os.Getenv("DOMAIN_CONCURRENCY"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid DOMAIN_CONCURRENCY %q: must be a non-negative integer", v)
+		}
+		l.defaultLimit = limit
+	}
+	for _, entry := range splitList(os.Getenv("DOMAIN_CONCURRENCY_OVERRIDES")) {
+		domain, value, ok := strings.Cut(entry, "=")
+		limit, err := strconv.Atoi(strings.TrimSpace(value))
+		if !ok || err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid DOMAIN_CONCURRENCY_OVERRIDES entry %q: expected domain=limit", entry)
+		}
+		l.overrides[strings.ToLower(strings.TrimSpace(domain))] = limit
+	}
+	if l.defaultLimit == 0 && len(l.overrides) == 0 {
+		return nil, nil
+	}
+	return l, nil
+}
+
+// acquire waits for a connection slot for every domain among to, returning a function
+// that gives them back. Slots are taken in sorted domain order so two messages to the
+// same domains can't each hold one slot the other needs.
+func (l *domainLimiter) acquire(ctx context.Context, to []string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	var domains []string
+	for _, addr := range to {
+		domains = append(domains, strings.ToLower(addr[strings.LastIndex(addr, "@")+1:]))
+	}
+	slices.Sort(domains)
+	domains = slices.Compact(domains)
+
+	var held []chan struct{}
+	release := func() {
+		for _, slot := range held {
+			<-slot
+		}
+	}
+	for _, domain := range domains {
+		slot := l.slot(domain)
+		if slot == nil {
+			continue
+		}
+		select {
+		case slot <- struct{}{}:
+			held = append(held, slot)
+		case <-ctx.Done():
+			release()
+			return nil, fmt.Errorf("waiting for a connection slot for %s: %w", domain, ctx.Err())
+		}
+	}
+	return release, nil
+}
+
+// slot returns the semaphore for domain, or nil when the domain is unlimited.
+func (l *domainLimiter) slot(domain string) chan struct{} {
+	limit, ok := l.overrides[domain]
+	if !ok {
+		limit = l.defaultLimit
+	}
+	if limit == 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	slot, ok := l.slots[domain]
+	if !ok {
+		slot = make(chan struct{}, limit)
+		l.slots[domain] = slot
+	}
+	return slot
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// newErrorDelayMiddleware holds back error responses for a random time between half and
+// all of ERROR_RESPONSE_DELAY, which spaces out callers that retry the instant they see a
+// non-2xx. This is a mitigation for badly behaved clients, not a fix; success responses
+// are never delayed.
+func newErrorDelayMiddleware() (fiber.Handler, error) {
+	v := os.Getenv("ERROR_RESPONSE_DELAY")
+	if v == "" {
+		return nil, nil
+	}
+	delay, err := time.ParseDuration(v)
+	if err != nil || delay <= 0 {
+		return nil, fmt.Errorf("invalid ERROR_RESPONSE_DELAY %q: must be a positive duration", v)
+	}
+
+	return func(c *fiber.Ctx) error {
+		err := c.Next()
+		if err != nil || c.Response().StatusCode() >= fiber.StatusBadRequest {
+			time.Sleep(delay/2 + rand.N(delay/2+1))
+		}
+		return err
+	}, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// sendError is one failed send as reported by GET /errors.
+type sendError struct {
+	Time       time.Time `json:"time"`
+	MessageID  string    `json:"messageId"`
+	Recipients []string  `json:"recipients"`
+	SMTPCode   int       `json:"smtpCode,omitempty"` // The relay's reply code, when it sent one
+	Message    string    `json:"message"`
+}
+
+// errorLog keeps the most recent send failures in a fixed-size ring buffer.
+type errorLog struct {
+	mu      sync.Mutex
+	entries []sendError
+	next    int  // Index the next entry is written to
+	full    bool // Whether entries has wrapped around at least once
+}
+
+// loadErrorLog sizes the error log from ERROR_LOG_SIZE, defaulting to 50 entries. A size
+// of 0 keeps no history.
+func loadErrorLog() (*errorLog, error) {
+	size := 50
+	if v := os.Getenv("ERROR_LOG_SIZE"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 0 {
+			return nil, fmt.Errorf("invalid ERROR_LOG_SIZE %q: must be a non-negative integer", v)
+		}
+		size = parsed
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	return &errorLog{entries: make([]sendError, size)}, nil
+}
+
+// record adds the failure of msg, overwriting the oldest entry once the log is full.
+func (l *errorLog) record(msg Message, err error) {
+	if l == nil {
+		return
+	}
+	entry := sendError{
+		Time:       time.Now().UTC(),
+		MessageID:  strings.Trim(msg.ID, "<>"),
+		Recipients: msg.To,
+		Message:    err.Error(),
+	}
+	var smtpErr *textproto.Error
+	if errors.As(err, &smtpErr) {
+		entry.SMTPCode = smtpErr.Code
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries[l.next] = entry
+	l.next = (l.next + 1) % len(l.entries)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// recent returns the recorded failures, newest first.
+func (l *errorLog) recent() []sendError {
+	recent := []sendError{}
+	if l == nil {
+		return recent
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	count := l.next
+	if l.full {
+		count = len(l.entries)
+	}
+	for i := 1; i <= count; i++ {
+		recent = append(recent, l.entries[(l.next-i+len(l.entries))%len(l.entries)])
+	}
+	return recent
+}
+
+// handler serves the recorded failures as JSON.
+func (l *errorLog) handler(c *fiber.Ctx) error {
+	return respond(c, fiber.StatusOK, fiber.Map{
+		"errors": l.recent(),
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// eventPublisher is a message queue backend that events are published to.
+type eventPublisher interface {
+	Publish(subject string, data []byte) error
+	FlushTimeout(timeout time.Duration) error
+	Close()
+}
+
+// eventSink publishes an event for every processed notification, for analytics
+// pipelines that want more than the email. A nil *eventSink publishes nothing.
+type eventSink struct {
+	publisher eventPublisher
+	subject   string
+}
+
+// notificationEvent is the structured event published for each notification.
+type notificationEvent struct {
+	Time    time.Time       `json:"time"`
+	Payload *WebhookPayload `json:"payload"`
+	Status  int             `json:"status"` // HTTP status the notification was answered with
+	Result  map[string]any  `json:"result"`
+}
+
+// loadEventSink connects to the backend named by EVENTS_BACKEND, publishing to
+// EVENTS_SUBJECT (default "emailsender.notifications"). Only "nats" is supported so far,
+// at EVENTS_URL.
+func loadEventSink() (*eventSink, error) {
+	backend := os.Getenv("EVENTS_BACKEND")
+	if backend == "" {
+		return nil, nil
+	}
+	sink := &eventSink{subject: "emailsender.notifications"}
+	if v := os.Getenv("EVENTS_SUBJECT"); v != "" {
+		sink.subject = v
+	}
+
+	switch backend {
+	case "nats":
+		url := os.Getenv("EVENTS_URL")
+		if url == "" {
+			url = nats.DefaultURL
+		}
+		// Keep trying in the background so an unavailable NATS server never stops email
+		conn, err := nats.Connect(url,
+			nats.Name("emailSender"),
+			nats.RetryOnFailedConnect(true),
+			nats.MaxReconnects(-1),
+			nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+				if err != nil {
+					log.Printf("Disconnected from NATS: %v", err)
+				}
+			}),
+			nats.ReconnectHandler(func(c *nats.Conn) {
+				log.Printf("Connected to NATS at %s", c.ConnectedUrlRedacted())
+			}),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EVENTS_URL %q: %w", url, err)
+		}
+		sink.publisher = conn
+	default:
+		return nil, fmt.Errorf("invalid EVENTS_BACKEND %q: must be nats", backend)
+	}
+	log.Printf("Publishing notification events to %s on %s", backend, sink.subject)
+	return sink, nil
+}
+
+// emit publishes the outcome r of payload. Failures are logged and otherwise ignored.
+func (s *eventSink) emit(payload *WebhookPayload, r result) {
+	if s == nil {
+		return
+	}
+	data, err := json.Marshal(notificationEvent{Time: time.Now().UTC(), Payload: payload, Status: r.status, Result: r.body})
+	if err != nil {
+		log.Printf("Error encoding notification event: %v", err)
+		return
+	}
+	if err := s.publisher.Publish(s.subject, data); err != nil {
+		log.Printf("Error publishing notification event: %v", err)
+	}
+}
+
+// close flushes pending events, waiting up to 5 seconds for the backend to take them,
+// and disconnects from it.
+func (s *eventSink) close() {
+	if s == nil {
+		return
+	}
+	if err := s.publisher.FlushTimeout(5 * time.Second); err != nil {
+		log.Printf("Error flushing notification events, some may be lost: %v", err)
+	}
+	s.publisher.Close()
+}
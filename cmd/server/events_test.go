@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// recordingPublisher records what it is asked to do, in order.
+type recordingPublisher struct {
+	calls []string
+}
+
+func (p *recordingPublisher) Publish(subject string, data []byte) error {
+	p.calls = append(p.calls, "publish "+subject)
+	return nil
+}
+
+func (p *recordingPublisher) FlushTimeout(time.Duration) error {
+	p.calls = append(p.calls, "flush")
+	return nil
+}
+
+func (p *recordingPublisher) Close() { p.calls = append(p.calls, "close") }
+
+func TestDigestEmitsEventPerPayload(t *testing.T) {
+	publisher := &recordingPublisher{}
+	n, capture := newTestNotifier()
+	n.events = &eventSink{publisher: publisher, subject: "events"}
+
+	payloads := []WebhookPayload{
+		{Status: "Success", EmailContent: "Subject: One\r\nok"},
+		{Status: "Failed", ExitCode: 8, EmailContent: "Subject: Two\r\nfailed"},
+	}
+	n.notifyDigest(context.Background(), payloads)
+	if len(capture.messages) != 1 {
+		t.Fatalf("sent %d messages, want one digest", len(capture.messages))
+	}
+	if len(publisher.calls) != len(payloads) {
+		t.Errorf("publisher calls = %v, want one event per payload", publisher.calls)
+	}
+
+	n.events.close()
+	if calls := publisher.calls[len(publisher.calls)-2:]; calls[0] != "flush" || calls[1] != "close" {
+		t.Errorf("close made calls %v, want a flush before closing", calls)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// timestampLayouts are the Timestamp formats accepted for replay protection: RFC 3339 as
+// written by PowerShell's Get-Date -Format o, and plain local date-times.
+var timestampLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02 15:04:05"}
+
+// timestampWindow rejects payloads whose Timestamp is too old, so a captured request
+// can't be replayed later to send a stale alert. A nil *timestampWindow accepts everything.
+type timestampWindow struct {
+	maxAge time.Duration
+	skew   time.Duration // Tolerated difference between the caller's clock and ours
+}
+
+// loadTimestampWindow enables the check when MAX_TIMESTAMP_AGE is set, allowing
+// TIMESTAMP_SKEW (default 1m) of clock difference either way.
+func loadTimestampWindow() (*timestampWindow, error) {
+	v := os.Getenv("MAX_TIMESTAMP_AGE")
+	if v == "" {
+		return nil, nil
+	}
+	maxAge, err := time.ParseDuration(v)
+	if err != nil || maxAge <= 0 {
+		return nil, fmt.Errorf("invalid MAX_TIMESTAMP_AGE %q: must be a positive duration", v)
+	}
+	w := &timestampWindow{maxAge: maxAge, skew: time.Minute}
+	if v := os.Getenv("TIMESTAMP_SKEW"); v != "" {
+		skew, err := time.ParseDuration(v)
+		if err != nil || skew < 0 {
+			return nil, fmt.Errorf("invalid TIMESTAMP_SKEW %q: must be a non-negative duration", v)
+		}
+		w.skew = skew
+	}
+	return w, nil
+}
+
+// check returns a 400 result for payloads without a usable Timestamp or with one outside
+// the window, and nil for the rest.
+func (w *timestampWindow) check(payload *WebhookPayload) *result {
+	if w == nil {
+		return nil
+	}
+	var ts time.Time
+	var err error
+	for _, layout := range timestampLayouts {
+		if ts, err = time.ParseInLocation(layout, strings.TrimSpace(payload.Timestamp), time.Local); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		log.Printf("Rejecting notification with missing or unrecognized timestamp %q", payload.Timestamp)
+		return &result{fiber.StatusBadRequest, fiber.Map{
+			"error": "timestamp is required and must be an RFC 3339 date-time",
+		}}
+	}
+
+	age := time.Since(ts)
+	if age > w.maxAge+w.skew || age < -w.skew {
+		log.Printf("Rejecting notification with timestamp %s, %s from now", payload.Timestamp, age.Round(time.Second))
+		return &result{fiber.StatusBadRequest, fiber.Map{
+			"error": fmt.Sprintf("timestamp is outside the accepted window of %s", w.maxAge),
+		}}
+	}
+	return nil
+}
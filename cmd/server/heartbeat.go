@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// runHeartbeat sends a heartbeat email to recipients every interval until ctx is cancelled,
+// so a silent inbox can be told apart from a broken notification path.
+func runHeartbeat(ctx context.Context, sender Sender, mail mailConfig, recipients []string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown host"
+	}
+
+	log.Printf("Sending heartbeat emails to %v every %s", recipients, interval)
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("Heartbeat stopped")
+			return
+		case now := <-ticker.C:
+			to := mail.Suppressed.filter(recipients, false)
+			if len(to) == 0 {
+				continue
+			}
+			msg := Message{
+				From:    mail.From,
+				To:      to,
+				Subject: "emailSender Heartbeat",
+				Body: fmt.Sprintf("This is a scheduled heartbeat from emailSender on %s at %s.\r\n\r\n"+
+					"If these stop arriving every %s, the notification path is broken.\r\n",
+					hostname, now.Format(time.RFC1123), interval),
+			}
+			for _, msg := range mail.withManageLinks(msg, true) {
+				if err := sender.Send(ctx, msg); err != nil {
+					log.Printf("Error sending heartbeat email to %s: %v", strings.Join(msg.To, ", "), err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// idempotencyHeader is the request header clients use to mark retries of the same request.
+const idempotencyHeader = "Idempotency-Key"
+
+// cachedResponse is a response recorded for an idempotency key.
+type cachedResponse struct {
+	status      int
+	contentType string
+	body        []byte
+	expires     time.Time
+	pending     bool
+}
+
+// idempotencyStore remembers responses by idempotency key so repeated requests
+// are answered from the cache instead of being processed again.
+type idempotencyStore struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]*cachedResponse
+}
+
+// newIdempotencyStore creates a store that keeps responses for ttl.
+func newIdempotencyStore(ttl time.Duration) *idempotencyStore {
+	return &idempotencyStore{
+		ttl:     ttl,
+		entries: make(map[string]*cachedResponse),
+	}
+}
+
+// middleware replays the cached response when a request repeats an Idempotency-Key.
+// Keys are scoped per endpoint, so the same key may be reused on different routes.
+// ?debug=true renders are never cached, so they can't answer the real send or the
+// other way round.
+func (s *idempotencyStore) middleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		key := c.Get(idempotencyHeader)
+		if key == "" || debugRequested(c) {
+			return c.Next()
+		}
+		scopedKey := c.Method() + " " + c.Path() + " " + key
+
+		s.mu.Lock()
+		s.purgeExpired()
+		if entry, ok := s.entries[scopedKey]; ok {
+			s.mu.Unlock()
+			if entry.pending {
+				return respond(c, fiber.StatusConflict, fiber.Map{
+					"error": "A request with this Idempotency-Key is already being processed",
+				})
+			}
+			log.Printf("Replaying cached response for Idempotency-Key %q on %s", key, c.Path())
+			c.Set(fiber.HeaderContentType, entry.contentType)
+			return c.Status(entry.status).Send(entry.body)
+		}
+		s.entries[scopedKey] = &cachedResponse{pending: true, expires: time.Now().Add(s.ttl)}
+		s.mu.Unlock()
+
+		// Let the client retry failed requests with the same key. This is deferred so a
+		// panic further down doesn't leave the key pending, refusing every retry until the
+		// entry expires.
+		cached := false
+		defer func() {
+			if !cached {
+				s.mu.Lock()
+				delete(s.entries, scopedKey)
+				s.mu.Unlock()
+			}
+		}()
+
+		err := c.Next()
+		status := c.Response().StatusCode()
+		if err != nil || status >= fiber.StatusInternalServerError {
+			return err
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.entries[scopedKey] = &cachedResponse{
+			status:      status,
+			contentType: string(c.Response().Header.ContentType()),
+			body:        append([]byte(nil), c.Response().Body()...), // fasthttp reuses the body buffer
+			expires:     time.Now().Add(s.ttl),
+		}
+		cached = true
+		return nil
+	}
+}
+
+// purgeExpired drops entries past their TTL. The caller must hold s.mu.
+func (s *idempotencyStore) purgeExpired() {
+	now := time.Now()
+	for key, entry := range s.entries {
+		if now.After(entry.expires) {
+			delete(s.entries, key)
+		}
+	}
+}
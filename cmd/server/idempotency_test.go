@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestIdempotencyAfterPanic(t *testing.T) {
+	app := fiber.New()
+	app.Use(recoverPanics)
+	calls := 0
+	app.Post("/webhook", newIdempotencyStore(time.Hour).middleware(), func(c *fiber.Ctx) error {
+		if calls++; calls == 1 {
+			panic("first attempt fails")
+		}
+		return c.SendStatus(fiber.StatusOK)
+	})
+
+	for i, want := range []int{fiber.StatusInternalServerError, fiber.StatusOK, fiber.StatusOK} {
+		req := httptest.NewRequest("POST", "/webhook", nil)
+		req.Header.Set(idempotencyHeader, "retry-me")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("request %d: %v", i+1, err)
+		}
+		if resp.StatusCode != want {
+			t.Errorf("request %d: status = %d, want %d", i+1, resp.StatusCode, want)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("handler ran %d times, want 2 with the third request replayed", calls)
+	}
+}
+
+func TestIdempotencySkipsDebug(t *testing.T) {
+	app := fiber.New()
+	calls := 0
+	app.Post("/webhook", newIdempotencyStore(time.Hour).middleware(), func(c *fiber.Ctx) error {
+		calls++
+		return c.SendString(c.Query("debug", "sent"))
+	})
+
+	for _, target := range []string{"/webhook?debug=true", "/webhook", "/webhook?debug=true", "/webhook"} {
+		req := httptest.NewRequest("POST", target, nil)
+		req.Header.Set(idempotencyHeader, "same-key")
+		if _, err := app.Test(req); err != nil {
+			t.Fatalf("%s: %v", target, err)
+		}
+	}
+	// Both debug renders and the first real send run; only the repeated send is replayed
+	if calls != 3 {
+		t.Errorf("handler ran %d times, want 3", calls)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// jobEntry is one composed notification held for its job's summary.
+type jobEntry struct {
+	subject, body string
+	sev           severity
+	id            identity
+}
+
+// jobRun collects the notifications of one job run.
+type jobRun struct {
+	entries  []jobEntry
+	lastSeen time.Time
+}
+
+// jobCollector holds notifications sharing a JobID until the job's end event arrives, or
+// no event has arrived for timeout, and then hands them over as one summary.
+// A nil *jobCollector holds nothing.
+type jobCollector struct {
+	timeout time.Duration
+
+	mu   sync.Mutex
+	runs map[string]*jobRun
+}
+
+// loadJobCollector reads JOB_SUMMARY_TIMEOUT. It returns nil when job summaries are off.
+func loadJobCollector() (*jobCollector, error) {
+	v := os.Getenv("JOB_SUMMARY_TIMEOUT")
+	if v == "" {
+		return nil, nil
+	}
+	timeout, err := time.ParseDuration(v)
+	if err != nil || timeout <= 0 {
+		return nil, fmt.Errorf("invalid JOB_SUMMARY_TIMEOUT %q: must be a positive duration", v)
+	}
+	return &jobCollector{timeout: timeout, runs: make(map[string]*jobRun)}, nil
+}
+
+// add records entry for jobID. When end is set the run is complete and all of its
+// entries are returned; otherwise add returns nil and the entry stays held.
+func (j *jobCollector) add(jobID string, entry jobEntry, end bool) []jobEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	run, ok := j.runs[jobID]
+	if !ok {
+		run = &jobRun{}
+		j.runs[jobID] = run
+	}
+	run.entries = append(run.entries, entry)
+	run.lastSeen = time.Now()
+	if !end {
+		return nil
+	}
+	delete(j.runs, jobID)
+	return run.entries
+}
+
+// takeExpired removes and returns the runs that have been quiet since before cutoff, or
+// every run when cutoff is zero.
+func (j *jobCollector) takeExpired(cutoff time.Time) map[string][]jobEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	expired := make(map[string][]jobEntry)
+	for jobID, run := range j.runs {
+		if cutoff.IsZero() || run.lastSeen.Before(cutoff) {
+			expired[jobID] = run.entries
+			delete(j.runs, jobID)
+		}
+	}
+	return expired
+}
+
+// run flushes runs whose end event never arrived until ctx is cancelled, then flushes
+// every run still held so shutting down doesn't lose them. Callers must wait for run to
+// return before exiting.
+func (j *jobCollector) run(ctx context.Context, flush func(ctx context.Context, jobID string, entries []jobEntry)) {
+	ticker := time.NewTicker(min(j.timeout, 10*time.Second))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			for jobID, entries := range j.takeExpired(time.Time{}) {
+				flush(context.WithoutCancel(ctx), jobID, entries)
+			}
+			return
+		case now := <-ticker.C:
+			for jobID, entries := range j.takeExpired(now.Add(-j.timeout)) {
+				log.Printf("No end event for job %s within %s, sending its summary", jobID, j.timeout)
+				flush(ctx, jobID, entries)
+			}
+		}
+	}
+}
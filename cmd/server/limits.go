@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// cancelOnShutdown cancels the request's user context, which Fiber starts out as
+// context.Background(), once the server begins shutting down, so sends still running
+// or waiting to retry give up instead of holding shutdown open.
+func cancelOnShutdown(c *fiber.Ctx) error {
+	ctx, cancel := context.WithCancel(c.UserContext())
+	defer cancel()
+	// fasthttp closes the request context's Done channel on shutdown; it is nil when the
+	// request isn't served by a listener
+	if shutdown := c.Context().Done(); shutdown != nil {
+		go func() {
+			select {
+			case <-shutdown:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	c.SetUserContext(ctx)
+	return c.Next()
+}
+
+// inFlightRetryAfter is the Retry-After value, in seconds, sent with shed requests.
+const inFlightRetryAfter = "5"
+
+// inFlightLimiter tracks concurrent requests in stats and, when max is positive, sheds
+// requests beyond that ceiling with 503 instead of queueing them.
+func inFlightLimiter(max int64) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		current := stats.inFlight.Add(1)
+		defer stats.inFlight.Add(-1)
+
+		if max > 0 && current > max {
+			c.Set(fiber.HeaderRetryAfter, inFlightRetryAfter)
+			return respond(c, fiber.StatusServiceUnavailable, fiber.Map{
+				"error": "Server is at capacity, retry later",
+			})
+		}
+		return c.Next()
+	}
+}
+
+// timeoutHeader lets callers set how long they are willing to wait for a send.
+const timeoutHeader = "X-Timeout-Ms"
+
+// requestTimeout bounds request handling by the X-Timeout-Ms header, capped at max.
+// Requests without the header are not bounded here.
+func requestTimeout(max time.Duration) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		v := c.Get(timeoutHeader)
+		if v == "" {
+			return c.Next()
+		}
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms <= 0 {
+			return respond(c, fiber.StatusBadRequest, fiber.Map{
+				"error": timeoutHeader + " must be a positive number of milliseconds",
+			})
+		}
+
+		timeout := min(time.Duration(ms)*time.Millisecond, max)
+		ctx, cancel := context.WithTimeout(c.UserContext(), timeout)
+		defer cancel()
+		c.SetUserContext(ctx)
+		return c.Next()
+	}
+}
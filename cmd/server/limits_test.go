@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// retryingSender fails every attempt with a temporary reply and waits an hour before
+// retrying, as a relay that stays unavailable would make SMTPSender do.
+type retryingSender struct {
+	attempted chan struct{}
+}
+
+func (s *retryingSender) Send(ctx context.Context, m Message) error {
+	policy := retryPolicy{maxAttempts: 10, baseDelay: time.Hour, retryOn: map[string]bool{"4xx": true}}
+	fake := &alwaysTemporary{}
+	return policy.do(ctx, func(ctx context.Context) error {
+		if fake.attempts == 0 {
+			close(s.attempted)
+		}
+		return fake.send(ctx)
+	})
+}
+
+func TestShutdownCancelsSend(t *testing.T) {
+	n, _ := newTestNotifier()
+	sender := &retryingSender{attempted: make(chan struct{})}
+	n.sender = sender
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	registerRoutes(app, n, nil, nil)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	go app.Listener(ln)
+
+	responses := make(chan int, 1)
+	go func() {
+		body := strings.NewReader(`{"status":"Failed","exitCode":8,"emailContent":"Robocopy output"}`)
+		resp, err := http.Post("http://"+ln.Addr().String()+"/webhook/robocopy-failure", fiber.MIMEApplicationJSON, body)
+		if err != nil {
+			responses <- 0
+			return
+		}
+		resp.Body.Close()
+		responses <- resp.StatusCode
+	}()
+
+	select {
+	case <-sender.attempted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the send was never attempted")
+	}
+	start := time.Now()
+	if err := app.ShutdownWithTimeout(5 * time.Second); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("shutdown took %s, waiting on the retry", elapsed)
+	}
+	if status := <-responses; status != fiber.StatusInternalServerError {
+		t.Errorf("status = %d, want the failed send answered with 500", status)
+	}
+}
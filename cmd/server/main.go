@@ -1,119 +1,438 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
-	"net/smtp"
 	"os"
+	"os/signal"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/joho/godotenv"
 )
 
-// WebhookPayload represents the expected structure of the incoming JSON from PowerShell
+// WebhookPayload represents the expected structure of the incoming JSON (or form-encoded) payload from PowerShell
 type WebhookPayload struct {
-	Status       string `json:"status"`
-	Timestamp    string `json:"timestamp"`
-	Source       string `json:"source"`
-	Destination  string `json:"destination"`
-	ExitCode     int    `json:"exitCode"`
-	EmailContent string `json:"emailContent"` // This field holds the pre-formatted email body
+	Status           string `json:"status" form:"status"`
+	Timestamp        string `json:"timestamp" form:"timestamp"`
+	Source           string `json:"source" form:"source"`
+	Destination      string `json:"destination" form:"destination"`
+	ExitCode         int    `json:"exitCode" form:"exitCode"`
+	EmailContent     string `json:"emailContent" form:"emailContent"`         // This field holds the pre-formatted email body
+	EmailContentHTML string `json:"emailContentHtml" form:"emailContentHtml"` // Sent as is as the HTML version of the email
+	Subject          string `json:"subject" form:"subject"`                   // Used as is when set, instead of a subject found in EmailContent
+	Host             string `json:"host" form:"host"`                         // Machine that ran the job; derived from Source when empty
+	JobID            string `json:"jobId" form:"jobId"`                       // Correlates the notifications of one job run
+	Event            string `json:"event" form:"event"`                       // "end" completes a job run; anything else is held
+	DeliverAt        string `json:"deliverAt" form:"deliverAt"`               // RFC 3339 time to hold non-fatal notifications until
+
+	Attachments []attachment `json:"-" form:"-"` // Files uploaded as multipart/form-data parts
 }
 
-// sendEmail sends an email using the configured SMTP server.
-func sendEmail(subject, body string) error {
-	// Load environment variables
-	err := godotenv.Load()
-	if err != nil {
-		log.Printf("Error loading .env file, attempting to use system environment variables: %v", err)
+// clone returns a copy of p that doesn't share memory with the request, which fasthttp
+// reuses once the handler returns.
+func (p *WebhookPayload) clone() *WebhookPayload {
+	return &WebhookPayload{
+		Status:           strings.Clone(p.Status),
+		Timestamp:        strings.Clone(p.Timestamp),
+		Source:           strings.Clone(p.Source),
+		Destination:      strings.Clone(p.Destination),
+		ExitCode:         p.ExitCode,
+		EmailContent:     strings.Clone(p.EmailContent),
+		EmailContentHTML: strings.Clone(p.EmailContentHTML),
+		Subject:          strings.Clone(p.Subject),
+		Host:             strings.Clone(p.Host),
+		JobID:            strings.Clone(p.JobID),
+		Event:            strings.Clone(p.Event),
+		DeliverAt:        strings.Clone(p.DeliverAt),
+		Attachments:      p.Attachments, // Read into buffers of their own
 	}
+}
 
-	smtpHost := os.Getenv("SMTP_HOST")
-	smtpPort := os.Getenv("SMTP_PORT")
-	smtpUsername := os.Getenv("SMTP_USERNAME")
-	smtpPassword := os.Getenv("SMTP_PASSWORD")
-	senderEmail := os.Getenv("SENDER_EMAIL")
-	recipientEmail := os.Getenv("RECIPIENT_EMAIL")
+// hostname returns the originating host of the payload, falling back to the server
+// name of a UNC Source path such as \\fileserver\share\folder.
+func (p *WebhookPayload) hostname() string {
+	if p.Host != "" {
+		return p.Host
+	}
+	if strings.HasPrefix(p.Source, `\\`) {
+		host, _, _ := strings.Cut(strings.TrimPrefix(p.Source, `\\`), `\`)
+		return host
+	}
+	return ""
+}
 
-	// Basic validation for environment variables
-	if smtpHost == "" || smtpPort == "" || smtpUsername == "" || smtpPassword == "" || senderEmail == "" || recipientEmail == "" {
-		return fmt.Errorf("SMTP configuration missing in .env or environment variables. Please check SMTP_HOST, SMTP_PORT, SMTP_USERNAME, SMTP_PASSWORD, SENDER_EMAIL, RECIPIENT_EMAIL")
+// version is reported in the X-Mailer header. Release builds set it with
+// -ldflags "-X main.version=1.2.3".
+var version = "dev"
+
+// errUnsupportedContentType is returned by parsePayload for bodies that are neither JSON nor a form.
+var errUnsupportedContentType = errors.New("unsupported content type")
+
+// parsePayload decodes the request body into a WebhookPayload based on its Content-Type.
+func parsePayload(c *fiber.Ctx) (*WebhookPayload, error) {
+	payload := new(WebhookPayload)
+	contentType := strings.ToLower(c.Get(fiber.HeaderContentType))
+	multipartForm := strings.HasPrefix(contentType, fiber.MIMEMultipartForm)
+	if !strings.HasPrefix(contentType, fiber.MIMEApplicationJSON) && !strings.HasPrefix(contentType, fiber.MIMEApplicationForm) && !multipartForm {
+		return nil, fmt.Errorf("%w %q", errUnsupportedContentType, contentType)
 	}
 
-	// Authentication
-	auth := smtp.PlainAuth("", smtpUsername, smtpPassword, smtpHost)
+	if strings.HasPrefix(contentType, fiber.MIMEApplicationForm) {
+		normalizeFormKeys(c)
+	}
+	if multipartForm {
+		values, attachments, err := parseUpload(c)
+		if err != nil {
+			return nil, err
+		}
+		normalizeMultipartKeys(values)
+		payload.Attachments = attachments
+		return payload, decodeFormValues(values, payload)
+	}
 
-	// Construct the full email message
-	msg := []byte("From: " + senderEmail + "\r\n" +
-		"To: " + recipientEmail + "\r\n" +
-		"Subject: " + subject + "\r\n" +
-		"MIME-version: 1.0;\nContent-Type: text/plain; charset=\"UTF-8\";\r\n" + // Ensure plain text and UTF-8
-		"\r\n" +
-		body)
+	// BodyParser picks the json or form struct tags depending on the Content-Type
+	if err := c.BodyParser(payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
 
-	// Send the email
-	addr := smtpHost + ":" + smtpPort
-	log.Printf("Attempting to send email from %s to %s via %s...", senderEmail, recipientEmail, addr)
-	err = smtp.SendMail(addr, auth, senderEmail, []string{recipientEmail}, msg)
-	if err != nil {
-		return fmt.Errorf("failed to send email: %w", err)
+// parseUpload streams the form values and files of a multipart/form-data request.
+func parseUpload(c *fiber.Ctx) (map[string][]string, []attachment, error) {
+	boundary := string(c.Request().Header.MultipartFormBoundary())
+	if boundary == "" {
+		return nil, nil, errors.New("multipart/form-data without a boundary")
+	}
+	body := uploadBody(c)
+	switch encoding := c.Get(fiber.HeaderContentEncoding); encoding {
+	case "":
+	case "gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot gunzip request body: %w", err)
+		}
+		// Decompressed, the body is held to the same limit
+		body = &limitedBody{r: gz, left: int64(c.App().Config().BodyLimit)}
+	default:
+		return nil, nil, fmt.Errorf("unsupported Content-Encoding %q", encoding)
 	}
+	return readUploads(body, boundary)
+}
 
-	log.Println("Email sent successfully!")
+// decodeFormValues sets the fields of payload from form values by their form tags, as
+// BodyParser does for url-encoded forms.
+func decodeFormValues(values map[string][]string, payload *WebhookPayload) error {
+	v := reflect.ValueOf(payload).Elem()
+	for i := range v.NumField() {
+		name := v.Type().Field(i).Tag.Get("form")
+		if name == "" || name == "-" || len(values[name]) == 0 {
+			continue
+		}
+		value := values[name][0]
+		switch field := v.Field(i); field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q: must be an integer", name, value)
+			}
+			field.SetInt(int64(n))
+		}
+	}
 	return nil
 }
 
 func main() {
-	// Initialize Fiber app
-	app := fiber.New()
-
-	// Define the webhook endpoint
-	app.Post("/webhook/robocopy-failure", func(c *fiber.Ctx) error {
-		// Parse the incoming JSON payload
-		payload := new(WebhookPayload)
-		if err := c.BodyParser(payload); err != nil {
-			log.Printf("Error parsing JSON body: %v", err)
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "Cannot parse request body",
-			})
+	configPath := flag.String("config", "", "YAML file with settings; environment variables override it")
+	sendMode := flag.Bool("send", false, "send one email and exit instead of starting the server")
+	to := flag.String("to", "", "comma-separated recipients for -send (default RECIPIENT_EMAIL)")
+	subject := flag.String("subject", "", "subject for -send")
+	body := flag.String("body", "", `body for -send, or "-" to read it from stdin`)
+	flag.Parse()
+
+	// Load environment variables
+	if err := godotenv.Load(); err != nil {
+		log.Printf("Error loading .env file, attempting to use system environment variables: %v", err)
+	}
+	if *configPath != "" {
+		if err := loadConfigFile(*configPath); err != nil {
+			log.Fatalf("Invalid config file: %v", err)
+		}
+	}
+	if err := resolveSecrets(); err != nil {
+		log.Fatalf("Invalid secret reference: %v", inConfigFile(err))
+	}
+	if err := loadAttachmentLimit(); err != nil {
+		log.Fatal(inConfigFile(err))
+	}
+
+	var sender Sender
+	hasFallback := false
+	switch backend := os.Getenv("MAIL_BACKEND"); backend {
+	case "", "smtp":
+		smtpSender, err := newSMTPSenderFromEnv()
+		if err != nil {
+			log.Fatalf("Invalid SMTP configuration: %v", inConfigFile(err))
 		}
+		sender, hasFallback = smtpSender, smtpSender.Fallback != nil
+	case "sendmail":
+		sendmailSender, err := newSendmailSenderFromEnv()
+		if err != nil {
+			log.Fatalf("Invalid sendmail configuration: %v", inConfigFile(err))
+		}
+		sender = sendmailSender
+	default:
+		log.Fatal(inConfigFile(fmt.Errorf("invalid MAIL_BACKEND %q: must be smtp or sendmail", backend)))
+	}
+	if err := runSelfTest(sender); err != nil {
+		log.Fatalf("Startup self-test failed: %v", inConfigFile(err))
+	}
+	mail, err := loadMailConfig()
+	if err != nil {
+		log.Fatalf("Invalid email configuration: %v", inConfigFile(err))
+	}
 
-		log.Printf("Received webhook for Robocopy status: %s, Exit Code: %d", payload.Status, payload.ExitCode)
-		log.Printf("Email content length: %d bytes", len(payload.EmailContent))
-
-		// Extract subject from the email content (first line after "Subject: ")
-		// The PowerShell script formats the subject as "Subject: Robocopy Failure Notification"
-		// We'll look for this line to extract the actual subject for the email.
-		emailLines := strings.Split(payload.EmailContent, "\n")
-		subject := "Robocopy Notification" // Default subject
-		for _, line := range emailLines {
-			if strings.HasPrefix(line, "Subject:") {
-				subject = strings.TrimSpace(strings.TrimPrefix(line, "Subject:"))
-				break
-			}
+	for _, route := range mail.SenderRoutes {
+		if route.id.Relay == relayFallback && !hasFallback {
+			log.Fatalf("SENDER_ROUTES sends %s through the fallback relay, but SMTP_FALLBACK_HOST and SMTP_FALLBACK_PORT are not set", route.id.From)
 		}
+	}
 
-		// Send the email with the extracted content
-		if err := sendEmail(subject, payload.EmailContent); err != nil {
-			log.Printf("Error sending email: %v", err)
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error":   "Failed to send email notification",
-				"details": err.Error(),
-			})
+	froms := []string{mail.From}
+	for _, route := range mail.SenderRoutes {
+		froms = append(froms, route.id.From)
+	}
+	if err := checkEnvelopeAlignment(os.Getenv("ENVELOPE_FROM"), froms); err != nil {
+		log.Fatal(inConfigFile(err))
+	}
+
+	port := 3000 // Default port if not specified in .env
+	if v := os.Getenv("PORT"); v != "" {
+		port, err = parsePort("PORT", v)
+		if err != nil {
+			log.Fatal(inConfigFile(err))
 		}
+	}
+
+	// Load optional payload transformation rules
+	var transforms []transformRule
+	if path := os.Getenv("TRANSFORM_RULES_FILE"); path != "" {
+		transforms, err = loadTransformRules(path)
+		if err != nil {
+			log.Fatalf("Invalid transform rules: %v", inConfigFile(err))
+		}
+		log.Printf("Loaded %d transform rules from %s", len(transforms), path)
+	}
 
-		// Return success response
-		return c.Status(fiber.StatusOK).JSON(fiber.Map{
-			"message": "Webhook received and email sent successfully",
+	subjectTemplate, err := loadSubjectTemplate()
+	if err != nil {
+		log.Fatal(inConfigFile(err))
+	}
+
+	// Hold non-fatal notifications during quiet hours
+	quiet, err := loadQuietHours()
+	if err != nil {
+		log.Fatalf("Invalid quiet hours configuration: %v", inConfigFile(err))
+	}
+
+	// Optionally combine the notifications of each job run into one summary
+	jobs, err := loadJobCollector()
+	if err != nil {
+		log.Fatal(inConfigFile(err))
+	}
+
+	presend, err := loadPresendHook()
+	if err != nil {
+		log.Fatal(inConfigFile(err))
+	}
+
+	errorLog, err := loadErrorLog()
+	if err != nil {
+		log.Fatal(inConfigFile(err))
+	}
+
+	threads, err := loadThreadTracker()
+	if err != nil {
+		log.Fatal(inConfigFile(err))
+	}
+
+	successes, err := loadSuccessFilter()
+	if err != nil {
+		log.Fatal(inConfigFile(err))
+	}
+
+	events, err := loadEventSink()
+	if err != nil {
+		log.Fatal(inConfigFile(err))
+	}
+
+	freshness, err := loadTimestampWindow()
+	if err != nil {
+		log.Fatal(inConfigFile(err))
+	}
+	pager, err := loadPagerDuty()
+	if err != nil {
+		log.Fatal(inConfigFile(err))
+	}
+	theme, err := loadHTMLTheme()
+	if err != nil {
+		log.Fatal(inConfigFile(err))
+	}
+	schedule, err := loadScheduler()
+	if err != nil {
+		log.Fatal(inConfigFile(err))
+	}
+
+	// One-shot mode for scripts and cron jobs: no HTTP server, just one email
+	if *sendMode {
+		n := &notifier{sender: sender, mail: mail, presend: presend}
+		os.Exit(sendOnce(n, splitList(*to), *subject, *body))
+	}
+
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		log.Fatalf("Invalid tracing configuration: %v", inConfigFile(err))
+	}
+
+	serverCfg, err := loadServerConfig()
+	if err != nil {
+		log.Fatal(inConfigFile(err))
+	}
+
+	// Initialize Fiber app
+	app := fiber.New(serverCfg.Config)
+	serverCfg.apply(app)
+	serverCfg.logEffective()
+
+	chain, err := loadWebhookMiddleware()
+	if err != nil {
+		log.Fatalf("Invalid middleware configuration: %v", inConfigFile(err))
+	}
+	validateChain, err := loadWebhookMiddleware(validateMiddleware...)
+	if err != nil {
+		log.Fatalf("Invalid middleware configuration: %v", inConfigFile(err))
+	}
+	n := &notifier{
+		sender:          sender,
+		mail:            mail,
+		transforms:      transforms,
+		quiet:           quiet,
+		presend:         presend,
+		jobs:            jobs,
+		errors:          errorLog,
+		threads:         threads,
+		successes:       successes,
+		events:          events,
+		freshness:       freshness,
+		pager:           pager,
+		theme:           theme,
+		schedule:        schedule,
+		subjectTemplate: subjectTemplate,
+	}
+	if os.Getenv("ALWAYS_ACCEPT") == "true" {
+		if n.queue, err = loadNotificationQueue(); err != nil {
+			log.Fatal(inConfigFile(err))
+		}
+		n.deadLetters = loadDeadLetters()
+		n.queue.start(n.notifyInBackground, n.notifyDigestInBackground)
+		stats.queue = n.queue
+	}
+	registerRoutes(app, n, chain, validateChain)
+
+	// Stop background work and the server on SIGINT/SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Optionally send heartbeat emails to prove the whole path works
+	if v := os.Getenv("HEARTBEAT_INTERVAL"); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil || interval <= 0 {
+			log.Fatal(inConfigFile(fmt.Errorf("invalid HEARTBEAT_INTERVAL %q: must be a positive duration", v)))
+		}
+		recipients := splitList(os.Getenv("HEARTBEAT_EMAIL"))
+		if len(recipients) == 0 {
+			log.Fatal("HEARTBEAT_EMAIL must be set when HEARTBEAT_INTERVAL is set")
+		}
+		if err := mail.checkRecipients(recipients); err != nil {
+			log.Fatal(inConfigFile(fmt.Errorf("invalid HEARTBEAT_EMAIL: %w", err)))
+		}
+		go runHeartbeat(ctx, sender, mail, recipients, interval)
+	}
+
+	// Loops that deliver held notifications, waited for before exiting so a flush in
+	// progress, or the job summaries sent on shutdown, finish first
+	var background sync.WaitGroup
+	runInBackground := func(loop func()) {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			loop()
+		}()
+	}
+	if quiet != nil {
+		runInBackground(func() { quiet.run(ctx, n.flushDeferred) })
+	}
+	if schedule != nil {
+		runInBackground(func() { schedule.run(ctx, n.sendScheduled) })
+	}
+	if jobs != nil {
+		runInBackground(func() {
+			jobs.run(ctx, func(ctx context.Context, jobID string, entries []jobEntry) {
+				if r := n.sendJobSummary(ctx, jobID, entries); r.status >= fiber.StatusBadRequest {
+					log.Printf("Job summary for %s failed with status %d: %v", jobID, r.status, r.body)
+				}
+			})
 		})
-	})
+	}
+
+	// Reload the suppression list on SIGHUP
+	if mail.Suppressed != nil {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := mail.Suppressed.reload(); err != nil {
+					log.Printf("Error reloading suppression list: %v", err)
+				}
+			}
+		}()
+	}
+
+	go func() {
+		<-ctx.Done()
+		log.Println("Shutting down...")
+		if err := app.Shutdown(); err != nil {
+			log.Printf("Error shutting down server: %v", err)
+		}
+	}()
 
 	// Start the Fiber server
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "3000" // Default port if not specified in .env
+	log.Printf("Fiber listening on :%d", port)
+	if err := app.Listen(":" + strconv.Itoa(port)); err != nil {
+		log.Fatal(err)
+	}
+
+	// Don't drop accepted notifications still held, queued or being sent. Listen returns
+	// once shutdown has begun, when ctx is already cancelled
+	background.Wait()
+	n.queue.close()
+	n.pager.wait()
+	n.events.close()
+
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(flushCtx); err != nil {
+		log.Printf("Error flushing traces: %v", err)
 	}
-	log.Printf("Fiber listening on :%s", port)
-	log.Fatal(app.Listen(":" + port))
 }
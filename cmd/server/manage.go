@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// manageLinks signs per-recipient links to GET /manage, where recipients of heartbeats
+// and digests can opt out of non-critical notifications themselves. Opt-outs are
+// recorded in the suppression file. A nil *manageLinks adds no links.
+type manageLinks struct {
+	secret     []byte
+	baseURL    string
+	suppressed *suppressionList
+}
+
+// loadManageLinks enables management links when MANAGE_SECRET is set. MANAGE_BASE_URL
+// is the address recipients reach this server at, and suppressed is where opt-outs go.
+func loadManageLinks(suppressed *suppressionList) (*manageLinks, error) {
+	secret := os.Getenv("MANAGE_SECRET")
+	if secret == "" {
+		return nil, nil
+	}
+	base := strings.TrimRight(os.Getenv("MANAGE_BASE_URL"), "/")
+	if u, err := url.Parse(base); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid MANAGE_BASE_URL %q: must be an http or https URL", base)
+	}
+	if suppressed == nil {
+		return nil, errors.New("SUPPRESSION_FILE must be set when MANAGE_SECRET is set, opt-outs are recorded there")
+	}
+	return &manageLinks{secret: []byte(secret), baseURL: base, suppressed: suppressed}, nil
+}
+
+// sign returns the MAC of addr, which must already be lowercased.
+func (l *manageLinks) sign(addr string) []byte {
+	mac := hmac.New(sha256.New, l.secret)
+	mac.Write([]byte(addr))
+	return mac.Sum(nil)
+}
+
+// url returns the management link for addr. The token carries the address, so links
+// keep working without any state on the server.
+func (l *manageLinks) url(addr string) string {
+	addr = strings.ToLower(addr)
+	token := base64.RawURLEncoding.EncodeToString([]byte(addr)) + "." + base64.RawURLEncoding.EncodeToString(l.sign(addr))
+	return l.baseURL + "/manage?token=" + token
+}
+
+// verify returns the address token was issued for, or false if it wasn't signed by us.
+func (l *manageLinks) verify(token string) (string, bool) {
+	encodedAddr, encodedMAC, ok := strings.Cut(token, ".")
+	addr, err := base64.RawURLEncoding.DecodeString(encodedAddr)
+	provided, macErr := base64.RawURLEncoding.DecodeString(encodedMAC)
+	if !ok || err != nil || macErr != nil || !hmac.Equal(provided, l.sign(string(addr))) {
+		return "", false
+	}
+	return string(addr), true
+}
+
+// managePage is shown to recipients following a management link.
+var managePage = template.Must(template.New("manage").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>emailSender notifications</title></head>
+<body>
+<p>{{.Message}}</p>
+{{if .Confirm}}<form method="post"><button type="submit">Unsubscribe</button></form>
+{{end}}</body>
+</html>
+`))
+
+// handler serves GET /manage, which asks for confirmation, and POST /manage, which opts
+// the token's address out. A bare GET never changes anything, so link scanners in mail
+// filters can't unsubscribe anyone.
+func (l *manageLinks) handler(c *fiber.Ctx) error {
+	if l == nil {
+		return respond(c, fiber.StatusNotFound, fiber.Map{
+			"error": "Management links are disabled, set MANAGE_SECRET to enable them",
+		})
+	}
+
+	addr, ok := l.verify(c.Query("token"))
+	if !ok {
+		log.Printf("Rejecting %s /manage with missing or invalid token", c.Method())
+		return renderManagePage(c, fiber.StatusForbidden, "This link is invalid. Copy the whole link from a recent notification and try again.", false)
+	}
+	if c.Method() != fiber.MethodPost {
+		return renderManagePage(c, fiber.StatusOK, "Unsubscribe "+addr+" from non-critical emailSender notifications? Fatal failures will still be sent.", true)
+	}
+
+	if err := l.suppressed.optOut(addr); err != nil {
+		log.Printf("Error recording opt-out of %s: %v", addr, err)
+		return renderManagePage(c, fiber.StatusInternalServerError, "Your opt-out could not be saved, please try again later.", false)
+	}
+	return renderManagePage(c, fiber.StatusOK, addr+" is unsubscribed from non-critical emailSender notifications. Fatal failures will still be sent.", false)
+}
+
+// renderManagePage writes managePage with the given status and message.
+func renderManagePage(c *fiber.Ctx, status int, message string, confirm bool) error {
+	var page strings.Builder
+	if err := managePage.Execute(&page, struct {
+		Message string
+		Confirm bool
+	}{message, confirm}); err != nil {
+		return err
+	}
+	c.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+	return c.Status(status).SendString(page.String())
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+)
+
+// messageBuilder renders Messages into the RFC 5322 format handed to the relay.
+type messageBuilder struct {
+	charset string
+	encoder *encoding.Encoder // Transcodes the UTF-8 body; nil when the charset is UTF-8
+	signer  *smimeSigner      // Signs every message when S/MIME is enabled
+
+	autoSubmitted string // Auto-Submitted header value (RFC 3834); empty leaves the header out
+	mailer        string // X-Mailer header value
+}
+
+// loadMessageBuilder reads the body charset from BODY_CHARSET, defaulting to UTF-8, the
+// Auto-Submitted header from AUTO_SUBMITTED, the X-Mailer header from X_MAILER and the
+// optional S/MIME signing settings.
+func loadMessageBuilder() (*messageBuilder, error) {
+	b := &messageBuilder{charset: "UTF-8", autoSubmitted: "auto-generated", mailer: "emailSender/" + version}
+	if name := os.Getenv("BODY_CHARSET"); name != "" {
+		enc, err := ianaindex.MIME.Encoding(name)
+		if err != nil || enc == nil {
+			return nil, fmt.Errorf("unsupported BODY_CHARSET %q", name)
+		}
+		charset, err := ianaindex.MIME.Name(enc)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported BODY_CHARSET %q: %w", name, err)
+		}
+		b.charset = charset
+		if charset != "UTF-8" {
+			// Characters the charset can't represent become a substitute rather than failing the send
+			b.encoder = encoding.ReplaceUnsupported(enc.NewEncoder())
+		}
+	}
+
+	// Marking the mail as automated keeps out-of-office replies from coming back
+	switch v := strings.ToLower(os.Getenv("AUTO_SUBMITTED")); v {
+	case "":
+	case "auto-generated", "auto-notified":
+		b.autoSubmitted = v
+	case "no", "false":
+		b.autoSubmitted = ""
+	default:
+		return nil, fmt.Errorf("invalid AUTO_SUBMITTED %q: expected auto-generated, auto-notified or no", v)
+	}
+
+	// Identifies mail from this service in deliverability reports and relay logs
+	if v := os.Getenv("X_MAILER"); v != "" {
+		if strings.ContainsAny(v, "\r\n") {
+			return nil, fmt.Errorf("invalid X_MAILER %q: must be a single line", v)
+		}
+		b.mailer = v
+	}
+
+	signer, err := loadSMIMESigner()
+	if err != nil {
+		return nil, err
+	}
+	b.signer = signer
+	return b, nil
+}
+
+// build renders m, transcoding the body into the configured charset.
+func (b *messageBuilder) build(m Message) ([]byte, error) {
+	id := m.ID
+	if id == "" {
+		id = newMessageID(m.From)
+	}
+
+	// The content, attachments included, is what gets signed, so it is rendered on its own first
+	var part bytes.Buffer
+	switch {
+	case m.HTMLBody == "":
+		if err := b.writePart(&part, "text/plain", m.Body); err != nil {
+			return nil, err
+		}
+	case m.Body == "":
+		if err := b.writePart(&part, "text/html", m.HTMLBody); err != nil {
+			return nil, err
+		}
+	default:
+		if err := b.writeAlternative(&part, m.Body, m.HTMLBody); err != nil {
+			return nil, err
+		}
+	}
+	if len(m.Attachments) > 0 {
+		var mixed bytes.Buffer
+		writeMixed(&mixed, part.Bytes(), m.Attachments)
+		part = mixed
+	}
+
+	// Construct the full email message
+	var msg bytes.Buffer
+	msg.WriteString(foldHeader("From", m.From) +
+		foldHeader("To", strings.Join(m.To, ", ")) +
+		foldHeader("Subject", encodeSubject(m.Subject)) +
+		"Message-ID: " + id + "\r\n")
+	if m.InReplyTo != "" {
+		msg.WriteString("In-Reply-To: " + m.InReplyTo + "\r\n" +
+			foldHeader("References", strings.Join(m.References, " ")))
+	}
+	if b.autoSubmitted != "" {
+		msg.WriteString("Auto-Submitted: " + b.autoSubmitted + "\r\n")
+	}
+	msg.WriteString(foldHeader("X-Mailer", mime.QEncoding.Encode("UTF-8", b.mailer)))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	if b.signer == nil {
+		msg.Write(part.Bytes())
+		return msg.Bytes(), nil
+	}
+	if err := b.signer.writeSigned(&msg, part.Bytes()); err != nil {
+		return nil, fmt.Errorf("signing message: %w", err)
+	}
+	return msg.Bytes(), nil
+}
+
+// writePart renders body as a single text part of the given media type, headers
+// included, transcoded into the configured charset.
+func (b *messageBuilder) writePart(w *bytes.Buffer, mediaType, body string) error {
+	if b.encoder != nil {
+		encoded, err := b.encoder.String(body)
+		if err != nil {
+			return fmt.Errorf("encoding body as %s: %w", b.charset, err)
+		}
+		body = encoded
+	}
+	cte := transferEncoding(body)
+	w.WriteString("Content-Type: " + mediaType + "; charset=\"" + b.charset + "\"\r\n" +
+		"Content-Transfer-Encoding: " + cte + "\r\n" +
+		"\r\n")
+	return writeEncodedBody(w, cte, body)
+}
+
+// writeAlternative renders text and html as a multipart/alternative entity, headers
+// included, with the HTML part last as the preferred one.
+func (b *messageBuilder) writeAlternative(w *bytes.Buffer, text, html string) error {
+	var random [16]byte
+	rand.Read(random[:])
+	boundary := "alt-" + hex.EncodeToString(random[:])
+
+	w.WriteString("Content-Type: multipart/alternative; boundary=\"" + boundary + "\"\r\n" +
+		"\r\n" +
+		"--" + boundary + "\r\n")
+	if err := b.writePart(w, "text/plain", text); err != nil {
+		return err
+	}
+	w.WriteString("\r\n--" + boundary + "\r\n")
+	if err := b.writePart(w, "text/html", html); err != nil {
+		return err
+	}
+	w.WriteString("\r\n--" + boundary + "--\r\n")
+	return nil
+}
+
+// newMessageID returns a globally unique Message-ID in the domain of the from address.
+func newMessageID(from string) string {
+	var random [12]byte
+	rand.Read(random[:])
+	domain := "localhost"
+	if at := strings.LastIndex(from, "@"); at >= 0 {
+		domain = from[at+1:]
+	}
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), hex.EncodeToString(random[:]), domain)
+}
+
+// headerField is one header of a rendered message, unfolded.
+type headerField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// headerFields returns the header block of a rendered message in order, with folded
+// lines joined back together.
+func headerFields(msg []byte) []headerField {
+	block, _, _ := bytes.Cut(msg, []byte("\r\n\r\n"))
+	var fields []headerField
+	for _, line := range strings.Split(string(block), "\r\n") {
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			if len(fields) > 0 {
+				fields[len(fields)-1].Value += line
+			}
+			continue
+		}
+		name, value, _ := strings.Cut(line, ":")
+		fields = append(fields, headerField{Name: name, Value: strings.TrimSpace(value)})
+	}
+	return fields
+}
+
+// logHeaders logs the envelope and complete header block of a message as one JSON line
+// for auditing. The body is never logged.
+func logHeaders(envelopeFrom string, envelopeTo []string, msg []byte) {
+	var entry bytes.Buffer
+	enc := json.NewEncoder(&entry)
+	enc.SetEscapeHTML(false) // Keep <message-id> and addresses readable
+	err := enc.Encode(map[string]any{
+		"envelopeFrom": envelopeFrom,
+		"envelopeTo":   envelopeTo,
+		"headers":      headerFields(msg),
+	})
+	if err != nil {
+		log.Printf("Error encoding message headers for logging: %v", err)
+		return
+	}
+	log.Printf("Outgoing message headers: %s", bytes.TrimSpace(entry.Bytes()))
+}
+
+// Header lines are folded at maxHeaderLineLength where possible (RFC 5322 section 2.1.1).
+// Words that wouldn't fit on a line of maxLineLength octets even on their own are encoded
+// so they can be split, since relays reject longer lines outright.
+const (
+	maxHeaderLineLength = 78
+	maxLineLength       = 998
+)
+
+// foldHeader renders a header field, folding value at spaces to keep lines short.
+func foldHeader(name, value string) string {
+	var b strings.Builder
+	b.WriteString(name + ":")
+	lineLength := len(name) + 1
+	for i, word := range strings.Split(value, " ") {
+		if i > 0 && lineLength+1+len(word) > maxHeaderLineLength {
+			b.WriteString("\r\n")
+			lineLength = 0
+		}
+		b.WriteString(" " + word)
+		lineLength += 1 + len(word)
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+// encodeSubject encodes a subject as RFC 2047 encoded-words when it contains non-ASCII
+// text or a word too long to fit on one line, such as a deep UNC path.
+func encodeSubject(subject string) string {
+	for _, word := range strings.Split(subject, " ") {
+		if len("Subject: ")+len(word) > maxLineLength {
+			return splitEncodedWords(subject)
+		}
+	}
+	return mime.QEncoding.Encode("UTF-8", subject)
+}
+
+// splitEncodedWords encodes s as space-separated base64 encoded-words, each short enough
+// to fold onto its own line. Chunks end on rune boundaries as RFC 2047 requires.
+func splitEncodedWords(s string) string {
+	const chunkSize = 45 // 60 characters of base64, 72 with the encoded-word delimiters
+	var words []string
+	for len(s) > 0 {
+		n := min(chunkSize, len(s))
+		for n < len(s) && n > 1 && !utf8.RuneStart(s[n]) {
+			n--
+		}
+		words = append(words, "=?UTF-8?B?"+base64.StdEncoding.EncodeToString([]byte(s[:n]))+"?=")
+		s = s[n:]
+	}
+	return strings.Join(words, " ")
+}
+
+// maxPlainLineLength is the longest line sent without encoding. RFC 5322 allows 998
+// octets, but relays are known to rewrap well before that.
+const maxPlainLineLength = 76
+
+// transferEncoding picks the Content-Transfer-Encoding for a text body: 7bit for short-lined
+// ASCII, base64 when most of it isn't ASCII, and quoted-printable for everything else.
+func transferEncoding(body string) string {
+	nonASCII := 0
+	longLines := false
+	lineLength := 0
+	for i := 0; i < len(body); i++ {
+		switch c := body[i]; {
+		case c == '\n':
+			lineLength = 0
+			continue
+		case c >= 0x80 || (c < 0x20 && c != '\r' && c != '\t'):
+			nonASCII++
+		}
+		if lineLength++; lineLength > maxPlainLineLength {
+			longLines = true
+		}
+	}
+
+	switch {
+	case nonASCII == 0 && !longLines:
+		return "7bit"
+	case nonASCII > len(body)/3:
+		return "base64"
+	default:
+		return "quoted-printable"
+	}
+}
+
+// writeEncodedBody writes body to w in the given Content-Transfer-Encoding.
+func writeEncodedBody(w io.Writer, cte, body string) error {
+	switch cte {
+	case "quoted-printable":
+		qp := quotedprintable.NewWriter(w)
+		if _, err := io.WriteString(qp, body); err != nil {
+			return err
+		}
+		return qp.Close()
+	case "base64":
+		encoded := base64.StdEncoding.EncodeToString([]byte(body))
+		for len(encoded) > maxPlainLineLength {
+			if _, err := io.WriteString(w, encoded[:maxPlainLineLength]+"\r\n"); err != nil {
+				return err
+			}
+			encoded = encoded[maxPlainLineLength:]
+		}
+		_, err := io.WriteString(w, encoded+"\r\n")
+		return err
+	default:
+		_, err := io.WriteString(w, body)
+		return err
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestBuildFoldsVeryLongLines(t *testing.T) {
+	path := `\\fileserver01\backups\` + strings.Repeat("deeply-nested-directory-", 200) + "report.log"
+	msg := Message{
+		From:    "sender@example.com",
+		To:      []string{"admin@example.com"},
+		Subject: "Failed to copy " + path,
+		Body:    "ERROR 5 (0x00000005) Copying File " + path + "\r\nAccess is denied.\r\n",
+	}
+
+	data, err := (&messageBuilder{charset: "UTF-8"}).build(msg)
+	if err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	for i, line := range strings.Split(string(data), "\r\n") {
+		if len(line) > maxLineLength {
+			t.Fatalf("line %d is %d octets long, more than %d", i+1, len(line), maxLineLength)
+		}
+	}
+
+	parsed, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("parsing built message: %v", err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+	if err != nil {
+		t.Fatalf("decoding subject: %v", err)
+	}
+	if subject != msg.Subject {
+		t.Errorf("subject did not survive encoding: got %d bytes, want %d", len(subject), len(msg.Subject))
+	}
+
+	if cte := parsed.Header.Get("Content-Transfer-Encoding"); cte != "quoted-printable" {
+		t.Fatalf("Content-Transfer-Encoding = %q, want quoted-printable", cte)
+	}
+	body, err := io.ReadAll(quotedprintable.NewReader(parsed.Body))
+	if err != nil {
+		t.Fatalf("decoding body: %v", err)
+	}
+	if string(body) != msg.Body {
+		t.Errorf("body did not survive encoding: got %d bytes, want %d", len(body), len(msg.Body))
+	}
+}
+
+func TestXMailerHeader(t *testing.T) {
+	tests := []struct {
+		name, setting, want string
+	}{
+		{"default", "", "emailSender/" + version},
+		{"overridden", "Backup Alerts 2.1", "Backup Alerts 2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("X_MAILER", tt.setting)
+			builder, err := loadMessageBuilder()
+			if err != nil {
+				t.Fatalf("loadMessageBuilder: %v", err)
+			}
+			stub := newSMTPStub(t, false)
+			sender := &SMTPSender{Primary: stub.relay(), Retry: retryPolicy{maxAttempts: 1}, Builder: builder}
+			msg := Message{From: "sender@example.com", To: []string{"admin@example.com"}, Subject: "Test", Body: "Hello"}
+			if err := sender.Send(context.Background(), msg); err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+
+			received := stub.received()
+			if len(received) != 1 {
+				t.Fatalf("received %d messages, want 1", len(received))
+			}
+			parsed, err := mail.ReadMessage(strings.NewReader(received[0].data))
+			if err != nil {
+				t.Fatalf("parsing received message: %v", err)
+			}
+			if got := parsed.Header.Get("X-Mailer"); got != tt.want {
+				t.Errorf("X-Mailer = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Setenv("X_MAILER", "emailSender\r\nBcc: attacker@example.com")
+	if _, err := loadMessageBuilder(); err == nil {
+		t.Error("a multi-line X_MAILER was accepted")
+	}
+}
@@ -0,0 +1,797 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// defaultBatchMaxItems caps the number of payloads accepted by /webhook/batch when BATCH_MAX_ITEMS is unset.
+const defaultBatchMaxItems = 100
+
+// emailBody is the content of an email besides its subject.
+type emailBody struct {
+	text        string
+	html        string // Sent as is, as an alternative to text when both are set
+	banner      bool   // Without html, render one from text with the severity banner
+	sev         severity
+	attachments []attachment
+	jobID       string    // Threads the email with earlier ones of the same job run
+	critical    bool      // Sent even to recipients who opted out of non-critical notifications
+	manageable  bool      // Carries per-recipient management links when MANAGE_SECRET is set
+	deliverAt   time.Time // Held until then when set, unless critical
+}
+
+// result is the outcome of handling one notification, as an HTTP status and response body.
+type result struct {
+	status int
+	body   fiber.Map
+}
+
+// notifier turns webhook payloads into emails and delivers them through sender.
+type notifier struct {
+	sender     Sender
+	mail       mailConfig
+	transforms []transformRule
+	quiet      *quietHours
+	presend    *presendHook
+	jobs       *jobCollector
+	errors     *errorLog
+	threads    *threadTracker
+	successes  *successFilter
+	events     *eventSink
+	freshness  *timestampWindow
+	pager      *pagerDuty
+	theme      *htmlTheme
+	schedule   *scheduler
+
+	subjectTemplate *template.Template
+
+	queue       *notificationQueue // With ALWAYS_ACCEPT, answer 202 once a payload passes every check and send from here
+	deadLetters *deadLetters       // Keeps the queued notifications that failed to send
+
+	dryRun bool // Set for ?debug=true requests, which aren't counted in stats
+}
+
+// sendRetryAfter is the Retry-After value, in seconds, sent with transient send failures.
+const sendRetryAfter = "60"
+
+// respondResult writes r, telling the caller when to try again if the send failed
+// transiently.
+func respondResult(c *fiber.Ctx, r result) error {
+	if r.body["transient"] == true {
+		c.Set(fiber.HeaderRetryAfter, sendRetryAfter)
+	}
+	return respond(c, r.status, r.body)
+}
+
+// webhookHandler handles a single robocopy notification.
+func (n *notifier) webhookHandler(c *fiber.Ctx) error {
+	// Parse the incoming JSON or form-encoded payload
+	_, span := tracer.Start(c.UserContext(), "validate")
+	payload, err := parsePayload(c)
+	if err != nil {
+		recordError(span, err)
+	}
+	span.End()
+	if errors.Is(err, errUnsupportedContentType) {
+		log.Printf("Rejecting request body: %v", err)
+		return respond(c, fiber.StatusUnsupportedMediaType, fiber.Map{
+			"error": "Content-Type must be application/json, application/x-www-form-urlencoded or multipart/form-data",
+		})
+	}
+	if errors.Is(err, errAttachmentTooLarge) || errors.Is(err, errBodyTooLarge) {
+		log.Printf("Rejecting request body: %v", err)
+		return respond(c, fiber.StatusRequestEntityTooLarge, fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if errors.Is(err, errInvalidSignature) {
+		log.Printf("Rejecting upload with an invalid signature")
+		return respond(c, fiber.StatusUnauthorized, fiber.Map{
+			"error": "Invalid signature",
+		})
+	}
+	if err != nil {
+		log.Printf("Error parsing request body: %v", err)
+		return respond(c, fiber.StatusBadRequest, fiber.Map{
+			"error": "Cannot parse request body",
+		})
+	}
+
+	if r := checkBody(payload); r != nil {
+		return respond(c, r.status, r.body)
+	}
+	if r := n.freshness.check(payload); r != nil {
+		return respond(c, r.status, r.body)
+	}
+	if r := n.schedule.check(payload); r != nil {
+		return respond(c, r.status, r.body)
+	}
+	if debugRequested(c) {
+		return n.debug(c, payload)
+	}
+	if n.queue != nil {
+		// Accept only what would get past the checks notify makes before sending
+		sev, _, r := n.route(payload)
+		if r != nil {
+			return respond(c, r.status, r.body)
+		}
+		if err := n.queue.push(payload.clone(), sev); err != nil {
+			return refuseUnqueued(c, err)
+		}
+		return respond(c, fiber.StatusAccepted, fiber.Map{
+			"message":   "Webhook accepted, email will be sent in the background",
+			"requestId": requestID(c),
+		})
+	}
+
+	r := n.notify(c.UserContext(), payload)
+	r.body["requestId"] = requestID(c)
+	return respondResult(c, r)
+}
+
+// notifyInBackground delivers a queued payload without a caller waiting on the result.
+// Failures, after the sender's own retries, are kept as dead letters.
+func (n *notifier) notifyInBackground(payload *WebhookPayload) {
+	original := payload.clone() // notify applies the transform rules in place
+	r := n.notify(context.Background(), payload)
+	if r.status < fiber.StatusBadRequest {
+		return
+	}
+	log.Printf("Background delivery failed with status %d: %v", r.status, r.body)
+	if err := n.deadLetters.add(original, r); err != nil {
+		log.Printf("Error keeping failed notification, it is lost: %v", err)
+		return
+	}
+	log.Printf("Failed notification kept in %s", n.deadLetters.path)
+}
+
+// notifyDigestInBackground delivers a queued digest as notifyInBackground does a single
+// notification, keeping every notification of a failed digest as a dead letter.
+func (n *notifier) notifyDigestInBackground(payloads []WebhookPayload) {
+	originals := make([]*WebhookPayload, len(payloads))
+	for i := range payloads {
+		originals[i] = payloads[i].clone()
+	}
+	r := n.notifyDigest(context.Background(), payloads)
+	if r.status < fiber.StatusBadRequest {
+		return
+	}
+	log.Printf("Background digest delivery failed with status %d: %v", r.status, r.body)
+	for _, original := range originals {
+		if err := n.deadLetters.add(original, r); err != nil {
+			log.Printf("Error keeping failed notification, it is lost: %v", err)
+		}
+	}
+	log.Printf("Failed notifications kept in %s", n.deadLetters.path)
+}
+
+// refuseUnqueued answers a notification the queue refused with err, which it only does
+// once the server is shutting down.
+func refuseUnqueued(c *fiber.Ctx, err error) error {
+	log.Printf("Not accepting webhook: %v", err)
+	c.Set(fiber.HeaderRetryAfter, sendRetryAfter)
+	return respond(c, fiber.StatusServiceUnavailable, fiber.Map{
+		"error": "Server is shutting down, retry later",
+	})
+}
+
+// route returns the severity and recipients notify would send payload with, after the
+// transform rules, and the result notify would fail it with if the recipients don't
+// pass the checks deliver makes. payload itself is left as is.
+func (n *notifier) route(payload *WebhookPayload) (severity, []string, *result) {
+	sev, r := n.transformedSeverity(payload)
+	if r != nil {
+		return 0, nil, r
+	}
+	to := n.mail.recipientsFor(sev)
+	if err := n.mail.checkRecipients(to); err != nil {
+		log.Printf("Rejecting notification: %v", err)
+		return sev, to, &result{fiber.StatusBadRequest, fiber.Map{
+			"error": err.Error(),
+		}}
+	}
+	return sev, to, nil
+}
+
+// transformedSeverity returns the severity of payload as the transform rules leave it, or
+// the result notify would fail it with if they can't be applied. payload itself is left as is.
+func (n *notifier) transformedSeverity(payload *WebhookPayload) (severity, *result) {
+	transformed := payload.clone()
+	if _, err := applyTransforms(n.transforms, transformed, ""); err != nil {
+		return 0, &result{fiber.StatusInternalServerError, fiber.Map{
+			"error":   "Failed to apply transform rules",
+			"details": err.Error(),
+		}}
+	}
+	return payloadSeverity(transformed), nil
+}
+
+// batchHandler handles a JSON array of notifications, sending one email per item or,
+// with ?digest=true, a single digest email covering all of them.
+func (n *notifier) batchHandler(c *fiber.Ctx) error {
+	if !strings.HasPrefix(strings.ToLower(c.Get(fiber.HeaderContentType)), fiber.MIMEApplicationJSON) {
+		return respond(c, fiber.StatusUnsupportedMediaType, fiber.Map{
+			"error": "Content-Type must be application/json",
+		})
+	}
+
+	var payloads []WebhookPayload
+	if err := json.Unmarshal(c.Body(), &payloads); err != nil {
+		log.Printf("Error parsing batch body: %v", err)
+		return respond(c, fiber.StatusBadRequest, fiber.Map{
+			"error": "Cannot parse request body, expected a JSON array of payloads",
+		})
+	}
+
+	maxItems := defaultBatchMaxItems
+	if v := os.Getenv("BATCH_MAX_ITEMS"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			maxItems = parsed
+		}
+	}
+	if len(payloads) == 0 || len(payloads) > maxItems {
+		return respond(c, fiber.StatusBadRequest, fiber.Map{
+			"error": fmt.Sprintf("Batch must contain between 1 and %d payloads", maxItems),
+		})
+	}
+	log.Printf("Received batch of %d webhooks", len(payloads))
+	for i := range payloads {
+		if r := n.freshness.check(&payloads[i]); r != nil {
+			r.body["index"] = i
+			return respond(c, r.status, r.body)
+		}
+		if r := n.schedule.check(&payloads[i]); r != nil {
+			r.body["index"] = i
+			return respond(c, r.status, r.body)
+		}
+	}
+
+	if n.queue != nil {
+		return n.acceptBatch(c, payloads, c.Query("digest") == "true")
+	}
+
+	if c.Query("digest") == "true" {
+		r := n.notifyDigest(c.UserContext(), payloads)
+		r.body["requestId"] = requestID(c)
+		return respondResult(c, r)
+	}
+
+	results := make([]fiber.Map, len(payloads))
+	for i := range payloads {
+		r := n.notify(c.UserContext(), &payloads[i])
+		item := fiber.Map{}
+		for key, value := range r.body {
+			item[key] = value
+		}
+		// The HTTP status of each item takes precedence over a "status" in its body
+		item["index"], item["status"] = i, r.status
+		results[i] = item
+	}
+	return respond(c, fiber.StatusOK, fiber.Map{
+		"results":   results,
+		"requestId": requestID(c),
+	})
+}
+
+// acceptBatch queues a batch for the background workers, as webhookHandler does a single
+// notification with ALWAYS_ACCEPT, once every item would get past the checks notify, or
+// for a digest notifyDigest, makes before sending. A failing item is answered with its index.
+func (n *notifier) acceptBatch(c *fiber.Ctx, payloads []WebhookPayload, digest bool) error {
+	sevs := make([]severity, len(payloads))
+	worst := severitySuccess
+	for i := range payloads {
+		r := checkBody(&payloads[i])
+		if r == nil && digest {
+			sevs[i], r = n.transformedSeverity(&payloads[i])
+		} else if r == nil {
+			sevs[i], _, r = n.route(&payloads[i])
+		}
+		if r != nil {
+			r.body["index"] = i
+			return respond(c, r.status, r.body)
+		}
+		worst = max(worst, sevs[i])
+	}
+
+	var err error
+	if digest {
+		// The digest goes to the recipients of its most severe notification alone
+		if err := n.mail.checkRecipients(n.mail.recipientsFor(worst)); err != nil {
+			log.Printf("Rejecting digest: %v", err)
+			return respond(c, fiber.StatusBadRequest, fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		queued := make([]WebhookPayload, len(payloads))
+		for i := range payloads {
+			queued[i] = *payloads[i].clone()
+		}
+		err = n.queue.pushDigest(queued, worst)
+	} else {
+		queued := make([]*WebhookPayload, len(payloads))
+		for i := range payloads {
+			queued[i] = payloads[i].clone()
+		}
+		err = n.queue.pushAll(queued, sevs)
+	}
+	if err != nil {
+		return refuseUnqueued(c, err)
+	}
+	return respond(c, fiber.StatusAccepted, fiber.Map{
+		"message":   fmt.Sprintf("Batch of %d accepted, email will be sent in the background", len(payloads)),
+		"requestId": requestID(c),
+	})
+}
+
+// notify composes and delivers the email for one payload.
+func (n *notifier) notify(ctx context.Context, payload *WebhookPayload) (r result) {
+	defer func() { n.events.emit(payload, r) }()
+	if !n.dryRun {
+		stats.recordReceived(payload)
+	}
+	log.Printf("Received webhook for Robocopy status: %s, Exit Code: %d", payload.Status, payload.ExitCode)
+	log.Printf("Email content length: %d bytes", len(payload.EmailContent))
+	if r := checkBody(payload); r != nil {
+		return *r
+	}
+
+	// Paging, suppression and routing all go by the payload as the transform rules leave it
+	subject, body, err := n.compose(ctx, payload)
+
+	// Page on-call before anything can hold or drop the email
+	n.pager.alert(ctx, payload)
+	if err != nil {
+		log.Printf("Error applying transform rules: %v", err)
+		return result{fiber.StatusInternalServerError, fiber.Map{
+			"error":   "Failed to apply transform rules",
+			"details": err.Error(),
+		}}
+	}
+	if n.successes.suppressed(payload) {
+		log.Printf("Suppressing success notification with exit code %d", payload.ExitCode)
+		return result{fiber.StatusOK, fiber.Map{
+			"status":  "suppressed",
+			"message": "Webhook received, success notifications are not emailed",
+		}}
+	}
+
+	sev := payloadSeverity(payload)
+	to := n.mail.recipientsFor(sev)
+	id := n.mail.identityFor(payload)
+
+	// Hold notifications that belong to a job run until the run ends
+	if n.jobs != nil && payload.JobID != "" {
+		entry := jobEntry{subject: subject, body: body, sev: sev, id: id}
+		entries := n.jobs.add(payload.JobID, entry, strings.EqualFold(payload.Event, "end"))
+		if entries == nil {
+			log.Printf("Holding notification for job %s until it ends", payload.JobID)
+			return result{fiber.StatusAccepted, fiber.Map{
+				"message": "Webhook received, email held for the job summary",
+				"jobId":   payload.JobID,
+			}}
+		}
+		return n.sendJobSummary(ctx, payload.JobID, entries)
+	}
+
+	// Optionally attach the decoded outcome for recipients' automation, after any uploads
+	attachments := slices.Clone(payload.Attachments)
+	if os.Getenv("ATTACH_STRUCTURED") == "true" {
+		status, err := statusAttachment(payload)
+		if err != nil {
+			log.Printf("Error encoding status attachment, sending without it: %v", err)
+		} else {
+			attachments = append(attachments, status)
+		}
+	}
+
+	deliverAt, err := n.schedule.deliverAt(payload)
+	if err != nil {
+		log.Printf("Sending now instead of at deliverAt: %v", err)
+	}
+
+	log.Printf("Routing %s notification from %s to %s", sev, id.From, strings.Join(to, ", "))
+	return n.deliverOrHold(ctx, sev, id, to, subject, emailBody{text: body, html: payload.EmailContentHTML, banner: true, attachments: attachments, jobID: payload.JobID, deliverAt: deliverAt})
+}
+
+// sendJobSummary delivers the notifications of one job run as a single email, routed by
+// the most severe of them.
+func (n *notifier) sendJobSummary(ctx context.Context, jobID string, entries []jobEntry) result {
+	worst := entries[0]
+	var summary strings.Builder
+	for i, entry := range entries {
+		if entry.sev > worst.sev {
+			worst = entry
+		}
+		writeDigestEntry(&summary, i, len(entries), entry.subject, entry.body)
+	}
+
+	noun := "notifications"
+	if len(entries) == 1 {
+		noun = "notification"
+	}
+	subject := fmt.Sprintf("Job %s: %s (%d %s)", jobID, worst.sev, len(entries), noun)
+	to := n.mail.recipientsFor(worst.sev)
+	log.Printf("Routing %s summary of job %s from %s to %s", worst.sev, jobID, worst.id.From, strings.Join(to, ", "))
+	return n.deliverOrHold(ctx, worst.sev, worst.id, to, subject, emailBody{text: summary.String(), jobID: jobID, manageable: true})
+}
+
+// notifyDigest coalesces payloads into a single digest email.
+func (n *notifier) notifyDigest(ctx context.Context, payloads []WebhookPayload) (r result) {
+	// Every payload gets an event with the outcome of the digest that carried it
+	defer func() {
+		for i := range payloads {
+			n.events.emit(&payloads[i], r)
+		}
+	}()
+	var digest strings.Builder
+	sev, worst := severitySuccess, 0
+	for i := range payloads {
+		if !n.dryRun {
+			stats.recordReceived(&payloads[i])
+		}
+		if r := checkBody(&payloads[i]); r != nil {
+			r.body["index"] = i
+			return *r
+		}
+		subject, body, err := n.compose(ctx, &payloads[i])
+		if err != nil {
+			log.Printf("Error applying transform rules: %v", err)
+			return result{fiber.StatusInternalServerError, fiber.Map{
+				"error":   "Failed to apply transform rules",
+				"details": err.Error(),
+				"index":   i,
+			}}
+		}
+		// Route by the severity the transform rules leave, as notify does
+		if s := payloadSeverity(&payloads[i]); s > sev {
+			sev, worst = s, i
+		}
+		writeDigestEntry(&digest, i, len(payloads), subject, body)
+	}
+
+	for i := range payloads {
+		n.pager.alert(ctx, &payloads[i])
+	}
+
+	subject := fmt.Sprintf("Robocopy Digest: %d notifications", len(payloads))
+	// Route the digest by its most severe notification
+	to := n.mail.recipientsFor(sev)
+	id := n.mail.identityFor(&payloads[worst])
+	log.Printf("Routing %s digest from %s to %s", sev, id.From, strings.Join(to, ", "))
+	return n.deliverOrHold(ctx, sev, id, to, subject, emailBody{text: digest.String(), manageable: true})
+}
+
+// writeDigestEntry appends the i-th of total emails to a digest body.
+func writeDigestEntry(digest *strings.Builder, i, total int, subject, body string) {
+	fmt.Fprintf(digest, "=== %d/%d: %s ===\r\n%s\r\n\r\n", i+1, total, subject, strings.TrimRight(body, "\r\n"))
+}
+
+// checkBody rejects payloads without EmailContent when REQUIRE_BODY is true. Otherwise
+// compose generates a body for them from the structured fields.
+func checkBody(payload *WebhookPayload) *result {
+	if os.Getenv("REQUIRE_BODY") != "true" || strings.TrimSpace(payload.EmailContent) != "" || strings.TrimSpace(payload.EmailContentHTML) != "" {
+		return nil
+	}
+	log.Println("Rejecting notification without emailContent")
+	return &result{fiber.StatusBadRequest, fiber.Map{
+		"error": "emailContent must not be empty",
+	}}
+}
+
+// fieldsBody describes a payload from its structured fields, for payloads without EmailContent.
+func fieldsBody(payload *WebhookPayload) string {
+	var body strings.Builder
+	body.WriteString("The notification did not include any email content.\r\n\r\n")
+	for _, field := range []struct{ name, value string }{
+		{"Status", payload.Status},
+		{"Exit code", strconv.Itoa(payload.ExitCode)},
+		{"Source", payload.Source},
+		{"Destination", payload.Destination},
+		{"Timestamp", payload.Timestamp},
+		{"Host", payload.hostname()},
+		{"Job", payload.JobID},
+	} {
+		if field.value != "" {
+			fmt.Fprintf(&body, "%s: %s\r\n", field.name, field.value)
+		}
+	}
+	return body.String()
+}
+
+// compose builds the subject and body of the email for payload, applying the transform
+// rules to payload in place.
+func (n *notifier) compose(ctx context.Context, payload *WebhookPayload) (string, string, error) {
+	_, span := tracer.Start(ctx, "render")
+	defer span.End()
+
+	// Prefer an explicit subject, then the configured subject template, falling back to
+	// the subject in the content
+	subject := strings.Join(strings.Fields(payload.Subject), " ")
+	if subject == "" && n.subjectTemplate != nil {
+		rendered, err := renderSubject(n.subjectTemplate, payload)
+		if err != nil {
+			log.Printf("Error rendering SUBJECT_TEMPLATE, falling back to extracted subject: %v", err)
+		}
+		subject = rendered
+	}
+	if subject == "" {
+		subject = extractSubject(payload.EmailContent)
+	}
+
+	// Apply any operator-defined transformation rules before building the email
+	subject, err := applyTransforms(n.transforms, payload, subject)
+	if err != nil {
+		recordError(span, err)
+		return "", "", err
+	}
+
+	// An HTML-only notification is sent without a text part
+	body := payload.EmailContent
+	if strings.TrimSpace(body) == "" && strings.TrimSpace(payload.EmailContentHTML) == "" {
+		body = fieldsBody(payload)
+	}
+	if os.Getenv("COLLAPSE_BLANK_LINES") == "true" {
+		body = collapseBlankLines(body)
+	}
+
+	// Optionally surface the robocopy summary table at the top of the email
+	if os.Getenv("ROBOCOPY_SUMMARY") == "true" {
+		if summary := parseRobocopySummary(payload.EmailContent); summary != nil {
+			log.Printf("Robocopy summary: %s", summary.logFields())
+			body = summary.table() + "\r\n" + body
+		} else {
+			log.Println("Robocopy summary not recognized in email content, skipping")
+		}
+	}
+
+	// Optionally tell recipients which machine the notification came from
+	if os.Getenv("INCLUDE_HOSTNAME") == "true" {
+		if host := payload.hostname(); host != "" {
+			subject = "[" + host + "] " + subject
+			if body != "" {
+				body = "Host: " + host + "\r\n\r\n" + body
+			}
+		}
+	}
+	return subject, body, nil
+}
+
+// deliverOrHold holds non-fatal notifications until their deliverAt time or while quiet
+// hours are active, and delivers everything else straight away.
+func (n *notifier) deliverOrHold(ctx context.Context, sev severity, id identity, to []string, subject string, body emailBody) result {
+	body.critical, body.sev = sev >= severityFatal, sev
+	msg := deferredMessage{To: to, From: id.From, Relay: id.Relay, Subject: subject, Body: body.text, HTML: body.html, Banner: body.banner, Severity: sev, Attachments: body.attachments, Manageable: body.manageable, Received: time.Now()}
+	if !body.critical && body.deliverAt.After(time.Now()) {
+		msg.DeliverAt = body.deliverAt
+		if err := n.schedule.hold(msg); err != nil {
+			log.Printf("Error scheduling notification: %v", err)
+			return result{fiber.StatusInternalServerError, fiber.Map{
+				"error":   "Failed to schedule email notification",
+				"details": err.Error(),
+			}}
+		}
+		log.Printf("Scheduling %s notification for %s", sev, body.deliverAt.Format(time.RFC3339))
+		return result{fiber.StatusAccepted, fiber.Map{
+			"message":   "Webhook received, email scheduled",
+			"deliverAt": body.deliverAt.Format(time.RFC3339),
+		}}
+	}
+	if body.critical || !n.quiet.active(time.Now()) {
+		return n.deliver(ctx, id, to, subject, body)
+	}
+
+	if err := n.quiet.hold(msg); err != nil {
+		log.Printf("Error deferring notification: %v", err)
+		return result{fiber.StatusInternalServerError, fiber.Map{
+			"error":   "Failed to defer email notification",
+			"details": err.Error(),
+		}}
+	}
+	log.Printf("Quiet hours active, deferring %s notification", sev)
+	return result{fiber.StatusAccepted, fiber.Map{
+		"message": "Webhook received, email deferred until quiet hours end",
+	}}
+}
+
+// sendScheduled delivers a notification once its deliverAt time has come, reporting
+// whether it failed transiently and should be retried.
+func (n *notifier) sendScheduled(ctx context.Context, msg deferredMessage) bool {
+	id := identity{From: msg.From, Relay: msg.Relay}
+	body := emailBody{text: msg.Body, html: msg.HTML, banner: msg.Banner, sev: msg.Severity, attachments: msg.Attachments, manageable: msg.Manageable}
+	r := n.deliver(ctx, id, msg.To, msg.Subject, body)
+	return r.status >= fiber.StatusInternalServerError
+}
+
+// flushDeferred delivers notifications held during quiet hours as one email per
+// sender and recipient list, returning the ones that could not be delivered.
+func (n *notifier) flushDeferred(ctx context.Context, msgs []deferredMessage) []deferredMessage {
+	var order []string
+	groups := make(map[string][]deferredMessage)
+	for _, msg := range msgs {
+		key := msg.From + "|" + msg.Relay + "|" + strings.Join(msg.To, ",")
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], msg)
+	}
+
+	var failed []deferredMessage
+	for _, key := range order {
+		group := groups[key]
+		subject, body := group[0].Subject, emailBody{text: group[0].Body, html: group[0].HTML, banner: group[0].Banner, sev: group[0].Severity, attachments: group[0].Attachments, manageable: group[0].Manageable}
+		if len(group) > 1 {
+			var digest strings.Builder
+			for i, msg := range group {
+				writeDigestEntry(&digest, i, len(group), msg.Subject+" (received "+msg.Received.Format(time.RFC1123)+")", msg.Body)
+			}
+			subject, body = fmt.Sprintf("Deferred Notifications: %d", len(group)), emailBody{text: digest.String(), manageable: true}
+		}
+		id := identity{From: group[0].From, Relay: group[0].Relay}
+		if id.From == "" {
+			id.From = n.mail.From
+		}
+		if r := n.deliver(ctx, id, group[0].To, subject, body); r.status >= fiber.StatusInternalServerError {
+			failed = append(failed, group...)
+		}
+	}
+	return failed
+}
+
+// deliver applies the footer and recipient policies to an email and sends it as id to to.
+func (n *notifier) deliver(ctx context.Context, id identity, to []string, subject string, body emailBody) result {
+	// The footer is added last so nothing else goes below it, and survives truncation.
+	// The HTML part is the caller's markup and is sent untouched; a banner version is
+	// rendered from the final text, so it carries the footer and respects MAX_BODY_LEN.
+	text, full := n.mail.truncated(body.text)
+	body.text = text
+	if full != nil {
+		// Clipped so the append never writes into an attachment slice the caller still holds
+		body.attachments = append(slices.Clip(body.attachments), *full)
+	}
+
+	// Refuse to email anyone outside the allowed domains
+	msg := Message{From: id.From, To: to, Subject: subject, Body: body.text, HTMLBody: body.html, Relay: id.Relay, Attachments: body.attachments}
+	if err := n.mail.checkRecipients(msg.To); err != nil {
+		log.Printf("Rejecting notification: %v", err)
+		return result{fiber.StatusBadRequest, fiber.Map{
+			"error": err.Error(),
+		}}
+	}
+
+	// Silently drop addresses on the suppression list
+	msg.To = n.mail.Suppressed.filter(msg.To, body.critical)
+	if len(msg.To) == 0 {
+		log.Println("All recipients are suppressed, not sending email")
+		return result{fiber.StatusOK, fiber.Map{
+			"message": "Webhook received, all recipients are suppressed",
+		}}
+	}
+
+	// Keep the sender's own copy out of the headers and out of the recipient policies
+	if n.mail.BccSender {
+		msg.Bcc = []string{msg.From}
+	}
+
+	msgs := n.mail.withManageLinks(msg, body.manageable)
+	if body.banner && msg.HTMLBody == "" {
+		for i := range msgs {
+			html, err := n.theme.render(body.sev, msgs[i].Subject, msgs[i].Body)
+			if err != nil {
+				log.Printf("Error rendering HTML banner, sending text only: %v", err)
+			}
+			msgs[i].HTMLBody = html
+		}
+	}
+	if len(msgs) == 1 {
+		return n.send(ctx, msgs[0], body.jobID)
+	}
+
+	// Each recipient gets their own copy; report the first failure once all were tried
+	var failed *result
+	var ids []string
+	for _, msg := range msgs {
+		r := n.send(ctx, msg, body.jobID)
+		if r.status >= fiber.StatusBadRequest {
+			if failed == nil {
+				failed = &r
+			}
+			continue
+		}
+		ids = append(ids, r.body["messageId"].(string))
+	}
+	if failed != nil {
+		return *failed
+	}
+	return result{fiber.StatusOK, fiber.Map{
+		"message":    "Webhook received and email sent successfully",
+		"messageIds": ids,
+		"recipients": msg.To,
+	}}
+}
+
+// send passes msg through the pre-send hook and sends it, threading it with earlier
+// emails of jobID.
+func (n *notifier) send(ctx context.Context, msg Message, jobID string) result {
+	msg.ID = newMessageID(msg.From)
+	msg.InReplyTo, msg.References = n.threads.headers(jobID, msg.From)
+
+	// Give the operator's policy hook the final say
+	if err := n.presend.check(ctx, msg); err != nil {
+		log.Printf("Not sending email: %v", err)
+		status := fiber.StatusBadGateway
+		if errors.Is(err, errPresendRejected) {
+			status = fiber.StatusForbidden
+		}
+		return result{status, fiber.Map{
+			"error":   "Email blocked by pre-send hook",
+			"details": err.Error(),
+		}}
+	}
+
+	ctx, span := tracer.Start(ctx, "send", trace.WithAttributes(
+		attribute.String("messaging.message.id", msg.ID),
+		attribute.Int("email.recipients", len(msg.To)),
+	))
+	defer span.End()
+	sendStart := time.Now()
+	err := n.sender.Send(ctx, msg)
+	if !n.dryRun {
+		stats.recordSend(time.Since(sendStart), err)
+	}
+	if err != nil {
+		n.errors.record(msg, err)
+	} else {
+		n.threads.record(jobID, msg.ID)
+	}
+	var rejected *recipientsRejectedError
+	if errors.As(err, &rejected) {
+		recordError(span, err)
+		log.Printf("Not sending email: %v", err)
+		return result{fiber.StatusBadRequest, fiber.Map{
+			"error":              "Relay rejected some recipients, email not sent",
+			"details":            err.Error(),
+			"rejectedRecipients": rejected.rejected,
+		}}
+	}
+	if err != nil {
+		recordError(span, err)
+		attempts, lastErr := sendAttempts(err)
+		status, body := fiber.StatusInternalServerError, fiber.Map{
+			"error":     "Failed to send email notification",
+			"details":   err.Error(),
+			"attempts":  attempts,
+			"lastError": lastErr.Error(),
+		}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			log.Printf("Gave up sending email at the request deadline: %v", err)
+			status, body["error"] = fiber.StatusGatewayTimeout, "Timed out sending email notification"
+		} else {
+			log.Printf("Error sending email: %v", err)
+		}
+		if transient(lastErr) {
+			body["transient"] = true
+		}
+		return result{status, body}
+	}
+
+	// Return success response
+	return result{fiber.StatusOK, fiber.Map{
+		"message":    "Webhook received and email sent successfully",
+		"messageId":  strings.Trim(msg.ID, "<>"),
+		"recipients": msg.To,
+	}}
+}
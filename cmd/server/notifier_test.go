@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// newTestNotifier returns a notifier mailing admin@example.com whose sender only records
+// the rendered messages.
+func newTestNotifier() (*notifier, *captureSender) {
+	capture := &captureSender{builder: &messageBuilder{charset: "UTF-8"}}
+	n := &notifier{
+		sender: capture,
+		mail:   mailConfig{From: "sender@example.com", To: []string{"admin@example.com"}},
+	}
+	return n, capture
+}
+
+func TestNotifyEmptyBody(t *testing.T) {
+	payload := &WebhookPayload{Status: "Failed", ExitCode: 8, Source: `C:\Data`, Destination: `\\backup\share`, EmailContent: " \r\n "}
+
+	t.Run("generated from fields", func(t *testing.T) {
+		n, capture := newTestNotifier()
+		if r := n.notify(context.Background(), payload); r.status != fiber.StatusOK {
+			t.Fatalf("status = %d, want 200: %v", r.status, r.body)
+		}
+		if len(capture.messages) != 1 {
+			t.Fatalf("sent %d messages, want 1", len(capture.messages))
+		}
+		body := capture.messages[0].MIME
+		for _, want := range []string{"did not include any email content", "Status: Failed", "Exit code: 8", `Source: C:\Data`, `Destination: \\backup\share`} {
+			if !strings.Contains(body, want) {
+				t.Errorf("generated body lacks %q:\n%s", want, body)
+			}
+		}
+	})
+
+	t.Run("rejected with REQUIRE_BODY", func(t *testing.T) {
+		t.Setenv("REQUIRE_BODY", "true")
+		n, capture := newTestNotifier()
+		if r := n.notify(context.Background(), payload); r.status != fiber.StatusBadRequest {
+			t.Fatalf("status = %d, want 400: %v", r.status, r.body)
+		}
+		if len(capture.messages) != 0 {
+			t.Errorf("sent %d messages, want none", len(capture.messages))
+		}
+	})
+}
+
+func TestComposeSubjectPrecedence(t *testing.T) {
+	tmpl := template.Must(template.New("subject").Parse("Templated {{ .Status }}"))
+	content := "Subject: From the content\r\nRobocopy output"
+	tests := []struct {
+		name     string
+		subject  string
+		template *template.Template
+		want     string
+	}{
+		{"explicit over template", "Explicit subject", tmpl, "Explicit subject"},
+		{"explicit over content", "Explicit subject", nil, "Explicit subject"},
+		{"explicit flattened", "  Explicit\r\n subject ", tmpl, "Explicit subject"},
+		{"template over content", "", tmpl, "Templated Failed"},
+		{"blank explicit falls through", " \t ", nil, "From the content"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, _ := newTestNotifier()
+			n.subjectTemplate = tt.template
+			payload := &WebhookPayload{Status: "Failed", ExitCode: 8, Subject: tt.subject, EmailContent: content}
+			subject, _, err := n.compose(context.Background(), payload)
+			if err != nil {
+				t.Fatalf("compose: %v", err)
+			}
+			if subject != tt.want {
+				t.Errorf("subject = %q, want %q", subject, tt.want)
+			}
+		})
+	}
+}
+
+func TestNotifyMaxRecipients(t *testing.T) {
+	const limit = 5
+	tests := []struct {
+		recipients int
+		want       int
+	}{
+		{limit - 1, fiber.StatusOK},
+		{limit, fiber.StatusOK},
+		{limit + 1, fiber.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d recipients", tt.recipients), func(t *testing.T) {
+			n, capture := newTestNotifier()
+			n.mail.MaxRecipients = limit
+			n.mail.To = nil
+			for i := range tt.recipients {
+				n.mail.To = append(n.mail.To, fmt.Sprintf("user%d@example.com", i))
+			}
+
+			r := n.notify(context.Background(), &WebhookPayload{Status: "Success", EmailContent: "Subject: Done\r\nAll files copied"})
+			if r.status != tt.want {
+				t.Fatalf("status = %d, want %d: %v", r.status, tt.want, r.body)
+			}
+			if sent := len(capture.messages) > 0; sent != (tt.want == fiber.StatusOK) {
+				t.Errorf("sent = %t with status %d", sent, r.status)
+			}
+			if tt.want == fiber.StatusBadRequest && !strings.Contains(fmt.Sprint(r.body["error"]), "too many recipients") {
+				t.Errorf("error = %v, want too many recipients", r.body["error"])
+			}
+		})
+	}
+}
+
+func TestLoadMailConfigMaxRecipients(t *testing.T) {
+	t.Setenv("SENDER_EMAIL", "sender@example.com")
+	t.Setenv("RECIPIENT_EMAIL", "a@example.com,b@example.com,c@example.com")
+	for limit, wantErr := range map[string]bool{"2": true, "3": false, "4": false, "0": false} {
+		t.Setenv("MAX_RECIPIENTS", limit)
+		if _, err := loadMailConfig(); (err != nil) != wantErr {
+			t.Errorf("MAX_RECIPIENTS=%s with 3 recipients: err = %v, want error %t", limit, err, wantErr)
+		}
+	}
+}
+
+// textParts parses a rendered message into its text parts, keyed by media type.
+func textParts(t *testing.T, data string) (string, map[string]string) {
+	t.Helper()
+	msg, err := mail.ReadMessage(strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("parsing message: %v", err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("parsing Content-Type: %v", err)
+	}
+	parts := make(map[string]string)
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		body, _ := io.ReadAll(msg.Body)
+		parts[mediaType] = string(body)
+		return mediaType, parts
+	}
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := r.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading part: %v", err)
+		}
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		body, _ := io.ReadAll(part)
+		parts[partType] = string(body)
+	}
+	return mediaType, parts
+}
+
+func TestNotifyBodyCombinations(t *testing.T) {
+	const text, html = "Subject: Report\r\nAll files copied\r\n", "<p>All <b>files</b> copied</p>"
+	tests := []struct {
+		name      string
+		text      string
+		html      string
+		mediaType string
+		parts     map[string]string
+	}{
+		{"text only", text, "", "text/plain", map[string]string{"text/plain": text}},
+		{"html only", "", html, "text/html", map[string]string{"text/html": html}},
+		{"both", text, html, "multipart/alternative", map[string]string{"text/plain": text, "text/html": html}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, capture := newTestNotifier()
+			r := n.notify(context.Background(), &WebhookPayload{Status: "Success", EmailContent: tt.text, EmailContentHTML: tt.html})
+			if r.status != fiber.StatusOK || len(capture.messages) != 1 {
+				t.Fatalf("status = %d with %d messages sent, want 200 and 1: %v", r.status, len(capture.messages), r.body)
+			}
+
+			mediaType, parts := textParts(t, capture.messages[0].MIME)
+			if mediaType != tt.mediaType {
+				t.Errorf("Content-Type = %s, want %s", mediaType, tt.mediaType)
+			}
+			if len(parts) != len(tt.parts) {
+				t.Errorf("got parts %v, want %v", parts, tt.parts)
+			}
+			for partType, want := range tt.parts {
+				if got := strings.TrimRight(parts[partType], "\r\n"); got != strings.TrimRight(want, "\r\n") {
+					t.Errorf("%s part = %q, want %q", partType, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNotifyInBackgroundKeepsDeadLetters(t *testing.T) {
+	n, capture := newTestNotifier()
+	n.mail.AllowedDomains = []string{"other.example"}
+	n.deadLetters = &deadLetters{path: filepath.Join(t.TempDir(), "dead-letter.jsonl")}
+
+	payload := &WebhookPayload{Status: "Failed", ExitCode: 8, EmailContent: "Subject: Copy failed\r\nDetails"}
+	if _, _, r := n.route(payload); r == nil || r.status != fiber.StatusBadRequest {
+		t.Fatalf("route = %v, want the recipient domain refused before accepting", r)
+	}
+	n.notifyInBackground(payload)
+	if len(capture.messages) != 0 {
+		t.Fatalf("sent %d messages, want none", len(capture.messages))
+	}
+
+	data, err := os.ReadFile(n.deadLetters.path)
+	if err != nil {
+		t.Fatalf("reading dead letters: %v", err)
+	}
+	var letter deadLetter
+	if err := json.Unmarshal(data, &letter); err != nil {
+		t.Fatalf("parsing dead letter %q: %v", data, err)
+	}
+	if letter.Status != fiber.StatusBadRequest || letter.Payload.EmailContent != payload.EmailContent {
+		t.Errorf("dead letter = %+v, want the payload with status 400", letter)
+	}
+}
+
+func TestNotifyDecidesOnTransformedPayload(t *testing.T) {
+	rulesPath := filepath.Join(t.TempDir(), "rules.txt")
+	// Downgrade a known-harmless fatal error to a success
+	rules := "ExitCode = Source == `C:\\Scratch` ? 0 : ExitCode\nStatus = ExitCode == 0 ? \"Success\" : Status\n"
+	if err := os.WriteFile(rulesPath, []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	transforms, err := loadTransformRules(rulesPath)
+	if err != nil {
+		t.Fatalf("loadTransformRules: %v", err)
+	}
+
+	n, capture := newTestNotifier()
+	n.transforms = transforms
+	n.successes = &successFilter{maxExitCode: 3}
+	r := n.notify(context.Background(), &WebhookPayload{Status: "Fatal", ExitCode: 16, Source: `C:\Scratch`, EmailContent: "Subject: Scratch copy\r\nIgnored"})
+	if r.body["status"] != "suppressed" || len(capture.messages) != 0 {
+		t.Errorf("result = %d %v with %d messages sent, want the transformed success suppressed", r.status, r.body, len(capture.messages))
+	}
+}
+
+func TestNotifyDigestRoutesByTransformedSeverity(t *testing.T) {
+	rulesPath := filepath.Join(t.TempDir(), "rules.txt")
+	// Anything copied to the archive share is critical
+	if err := os.WriteFile(rulesPath, []byte("Status = Destination == `\\\\archive\\share` ? \"Fatal\" : Status\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	transforms, err := loadTransformRules(rulesPath)
+	if err != nil {
+		t.Fatalf("loadTransformRules: %v", err)
+	}
+
+	n, capture := newTestNotifier()
+	n.transforms = transforms
+	n.mail.Routes = map[severity][]string{severityFatal: {"oncall@example.com"}}
+	payloads := []WebhookPayload{
+		{Status: "Success", ExitCode: 1, Destination: `\\backup\share`, EmailContent: "Copied"},
+		{Status: "Success", ExitCode: 1, Destination: `\\archive\share`, EmailContent: "Copied"},
+	}
+	if r := n.notifyDigest(context.Background(), payloads); r.status != fiber.StatusOK {
+		t.Fatalf("status = %d, want 200: %v", r.status, r.body)
+	}
+	if len(capture.messages) != 1 || strings.Join(capture.messages[0].Recipients, ",") != "oncall@example.com" {
+		t.Errorf("digest sent to %v, want it routed as fatal to oncall@example.com", capture.messages)
+	}
+}
+
+func TestNotifyAttachesFullBody(t *testing.T) {
+	payload := &WebhookPayload{Status: "Failed", ExitCode: 8, EmailContent: strings.Repeat("Copying file\r\n", 100)}
+	for _, attach := range []bool{false, true} {
+		n, capture := newTestNotifier()
+		n.mail.MaxBodyLen, n.mail.AttachFullBody = 300, attach
+		if r := n.notify(context.Background(), payload.clone()); r.status != fiber.StatusOK {
+			t.Fatalf("status = %d, want 200: %v", r.status, r.body)
+		}
+		mime := capture.messages[0].MIME
+		if got := strings.Contains(mime, `filename="body.txt"`); got != attach {
+			t.Errorf("MAX_BODY_ATTACH %t: body.txt attached = %t", attach, got)
+		}
+		if want := "[truncated, the original body of 1400 bytes is attached as body.txt]"; strings.Contains(mime, want) != attach {
+			t.Errorf("MAX_BODY_ATTACH %t: marker pointing to body.txt present = %t:\n%s", attach, !attach, mime)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// pagerDutyEventsURL is the PagerDuty Events API v2 endpoint.
+const pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+// pagerDuty opens PagerDuty incidents for fatal notifications, alongside the email. A
+// nil *pagerDuty sends nothing.
+type pagerDuty struct {
+	routingKey string
+	url        string
+	client     *http.Client
+	resolve    bool // Resolve a job's incident when the job later succeeds
+
+	pending sync.WaitGroup // Events still being sent
+}
+
+// pagerDutyEvent is a PagerDuty Events API v2 event.
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key,omitempty"`
+	Client      string            `json:"client,omitempty"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+// pagerDutyPayload describes the alert of a trigger event.
+type pagerDutyPayload struct {
+	Summary       string         `json:"summary"`
+	Source        string         `json:"source"`
+	Severity      string         `json:"severity"`
+	Timestamp     string         `json:"timestamp,omitempty"`
+	CustomDetails map[string]any `json:"custom_details"`
+}
+
+// loadPagerDuty enables the integration when PAGERDUTY_ROUTING_KEY is set. With
+// PAGERDUTY_RESOLVE, a success payload resolves the incident opened for its JobID.
+func loadPagerDuty() (*pagerDuty, error) {
+	key := os.Getenv("PAGERDUTY_ROUTING_KEY")
+	if key == "" {
+		return nil, nil
+	}
+	pd := &pagerDuty{
+		routingKey: key,
+		url:        pagerDutyEventsURL,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		resolve:    os.Getenv("PAGERDUTY_RESOLVE") == "true",
+	}
+	if v := os.Getenv("PAGERDUTY_URL"); v != "" {
+		pd.url = v
+	}
+	log.Printf("Opening PagerDuty incidents for fatal notifications")
+	return pd, nil
+}
+
+// dedupKey ties the incidents of a job together, so repeated failures update one
+// incident and a later success can resolve it. Payloads without a JobID get none.
+func dedupKey(payload *WebhookPayload) string {
+	if payload.JobID == "" {
+		return ""
+	}
+	return "emailsender-" + payload.JobID
+}
+
+// alert triggers an incident for a fatal payload, or resolves the incident of a job
+// that succeeded. The event is sent in the background, so a slow Events API never holds
+// up the email; failures are only logged.
+func (pd *pagerDuty) alert(ctx context.Context, payload *WebhookPayload) {
+	if pd == nil {
+		return
+	}
+
+	event := pagerDutyEvent{RoutingKey: pd.routingKey, DedupKey: dedupKey(payload), Client: "emailSender"}
+	switch sev := payloadSeverity(payload); {
+	case sev >= severityFatal:
+		event.EventAction = "trigger"
+		event.Payload = pagerDutyAlert(payload)
+	case sev == severitySuccess && pd.resolve && event.DedupKey != "":
+		event.EventAction = "resolve"
+	default:
+		return
+	}
+
+	// Encoded now, since payload may share memory with a request that is about to end
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error encoding PagerDuty %s event: %v", event.EventAction, err)
+		return
+	}
+	ctx = context.WithoutCancel(ctx) // The client timeout bounds the send instead
+	pd.pending.Add(1)
+	go func() {
+		defer pd.pending.Done()
+		if err := pd.send(ctx, data); err != nil {
+			log.Printf("Error sending PagerDuty %s event: %v", event.EventAction, err)
+			return
+		}
+		log.Printf("Sent PagerDuty %s event, dedup key %q", event.EventAction, event.DedupKey)
+	}()
+}
+
+// wait blocks until the events already handed to alert have been sent.
+func (pd *pagerDuty) wait() {
+	if pd == nil {
+		return
+	}
+	pd.pending.Wait()
+}
+
+// maxPagerDutySummary is the longest summary, in bytes, the Events API accepts.
+const maxPagerDutySummary = 1024
+
+// pagerDutyAlert describes payload for the incident it triggers.
+func pagerDutyAlert(payload *WebhookPayload) *pagerDutyPayload {
+	summary, source := "Robocopy fatal error", "emailSender"
+	if host := payload.hostname(); host != "" {
+		summary, source = summary+" on "+host, host
+	}
+	summary += fmt.Sprintf(" (exit code %d)", payload.ExitCode)
+	if payload.Source != "" || payload.Destination != "" {
+		summary += fmt.Sprintf(": %s -> %s", payload.Source, payload.Destination)
+	}
+	if len(summary) > maxPagerDutySummary {
+		// Cut before a whole character, as splitEncodedWords does, so the summary stays valid UTF-8
+		n := maxPagerDutySummary
+		for n > 0 && !utf8.RuneStart(summary[n]) {
+			n--
+		}
+		summary = summary[:n]
+	}
+
+	alert := &pagerDutyPayload{
+		Summary:  summary,
+		Source:   source,
+		Severity: "critical",
+		CustomDetails: map[string]any{
+			"status":      payload.Status,
+			"exitCode":    payload.ExitCode,
+			"source":      payload.Source,
+			"destination": payload.Destination,
+			"jobId":       payload.JobID,
+		},
+	}
+	// PagerDuty rejects timestamps that aren't ISO 8601, so only pass on valid ones
+	if ts, err := time.Parse(time.RFC3339, payload.Timestamp); err == nil {
+		alert.Timestamp = ts.Format(time.RFC3339)
+	}
+	return alert
+}
+
+// send posts the encoded event data to the Events API, which answers 202 once it is
+// queued.
+func (pd *pagerDuty) send(ctx context.Context, data []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, pd.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := pd.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("PagerDuty answered %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestPagerDutyAlertInBackground(t *testing.T) {
+	var mu sync.Mutex
+	var events []pagerDutyEvent
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		var event pagerDutyEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		mu.Lock()
+		events = append(events, event)
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer api.Close()
+
+	pd := &pagerDuty{routingKey: "key", url: api.URL, client: api.Client()}
+	ctx, cancel := context.WithCancel(context.Background())
+	start := time.Now()
+	pd.alert(ctx, &WebhookPayload{Status: "Fatal", ExitCode: 16, JobID: "nightly"})
+	cancel() // The request ending must not abort the event
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("alert took %s, want it to return before the Events API answers", elapsed)
+	}
+
+	pd.wait()
+	if len(events) != 1 || events[0].EventAction != "trigger" || events[0].DedupKey != "emailsender-nightly" {
+		t.Errorf("events = %+v, want one trigger for the job", events)
+	}
+}
+
+func TestPagerDutySummaryTruncation(t *testing.T) {
+	// Each "é" is two bytes, one of which lands on the limit
+	alert := pagerDutyAlert(&WebhookPayload{Status: "Fatal", ExitCode: 16, Source: strings.Repeat("é", 600), Destination: `\\backup\share`})
+	if len(alert.Summary) > maxPagerDutySummary {
+		t.Errorf("summary is %d bytes, want at most %d", len(alert.Summary), maxPagerDutySummary)
+	}
+	if !utf8.ValidString(alert.Summary) {
+		t.Errorf("summary was cut inside a character: %q", alert.Summary[len(alert.Summary)-4:])
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// paused is set while operators have stopped webhook intake with POST /admin/pause.
+var paused atomic.Bool
+
+// pauseRetryAfter is the Retry-After value, in seconds, sent while paused.
+const pauseRetryAfter = "60"
+
+// rejectWhilePaused answers webhook requests with 503 while intake is paused.
+func rejectWhilePaused(c *fiber.Ctx) error {
+	if paused.Load() {
+		c.Set(fiber.HeaderRetryAfter, pauseRetryAfter)
+		return respond(c, fiber.StatusServiceUnavailable, fiber.Map{
+			"error": "Webhook intake is paused for maintenance, retry later",
+		})
+	}
+	return c.Next()
+}
+
+// pauseHandler stops webhook intake until resumeHandler is called.
+func pauseHandler(c *fiber.Ctx) error {
+	if !paused.Swap(true) {
+		log.Println("Webhook intake paused")
+	}
+	return respond(c, fiber.StatusOK, fiber.Map{"paused": true})
+}
+
+// resumeHandler restarts webhook intake after pauseHandler.
+func resumeHandler(c *fiber.Ctx) error {
+	if paused.Swap(false) {
+		log.Println("Webhook intake resumed")
+	}
+	return respond(c, fiber.StatusOK, fiber.Map{"paused": false})
+}
+
+// healthHandler reports that the process is up, and whether webhook intake is paused.
+func healthHandler(c *fiber.Ctx) error {
+	return respond(c, fiber.StatusOK, fiber.Map{
+		"status": "ok",
+		"paused": paused.Load(),
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// errPresendRejected is returned when the pre-send hook declines a message.
+var errPresendRejected = errors.New("rejected by pre-send hook")
+
+// presendHook asks an external HTTP endpoint for permission before each send. A nil
+// *presendHook allows everything.
+type presendHook struct {
+	url      string
+	client   *http.Client
+	failOpen bool // Send anyway when the hook can't be reached
+}
+
+// loadPresendHook reads PRESEND_HOOK_URL, PRESEND_HOOK_TIMEOUT and PRESEND_HOOK_FAIL_OPEN.
+// It returns nil when no hook is configured.
+func loadPresendHook() (*presendHook, error) {
+	url := os.Getenv("PRESEND_HOOK_URL")
+	if url == "" {
+		return nil, nil
+	}
+
+	timeout := 5 * time.Second
+	if v := os.Getenv("PRESEND_HOOK_TIMEOUT"); v != "" {
+		parsed, err := time.ParseDuration(v)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid PRESEND_HOOK_TIMEOUT %q: must be a positive duration", v)
+		}
+		timeout = parsed
+	}
+	return &presendHook{
+		url:      url,
+		client:   &http.Client{Timeout: timeout},
+		failOpen: os.Getenv("PRESEND_HOOK_FAIL_OPEN") == "true",
+	}, nil
+}
+
+// check posts the metadata of msg to the hook. It returns errPresendRejected when the
+// hook answers with anything but 200 or a 5xx, and other errors when the hook can't be
+// reached or answers 5xx and the hook fails closed.
+func (h *presendHook) check(ctx context.Context, msg Message) error {
+	if h == nil {
+		return nil
+	}
+
+	metadata, err := json.Marshal(map[string]any{
+		"messageId": strings.Trim(msg.ID, "<>"),
+		"from":      msg.From,
+		"to":        msg.To,
+		"subject":   msg.Subject,
+		"bodyBytes": len(msg.Body),
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(metadata))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		if h.failOpen {
+			log.Printf("Pre-send hook unavailable, sending anyway: %v", err)
+			return nil
+		}
+		return fmt.Errorf("pre-send hook unavailable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	reason, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	// A 5xx means the hook is down or broken, not that it decided against the message
+	if resp.StatusCode >= http.StatusInternalServerError {
+		if h.failOpen {
+			log.Printf("Pre-send hook unavailable with status %d, sending anyway: %s", resp.StatusCode, bytes.TrimSpace(reason))
+			return nil
+		}
+		return fmt.Errorf("pre-send hook unavailable with status %d: %s", resp.StatusCode, bytes.TrimSpace(reason))
+	}
+	return fmt.Errorf("%w with status %d: %s", errPresendRejected, resp.StatusCode, bytes.TrimSpace(reason))
+}
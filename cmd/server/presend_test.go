@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPresendHookStatuses(t *testing.T) {
+	tests := []struct {
+		status   int
+		failOpen bool
+		wantErr  bool
+		rejected bool
+	}{
+		{http.StatusOK, false, false, false},
+		{http.StatusForbidden, false, true, true},
+		{http.StatusForbidden, true, true, true},
+		{http.StatusServiceUnavailable, false, true, false},
+		{http.StatusServiceUnavailable, true, false, false},
+		{http.StatusInternalServerError, true, false, false},
+	}
+	for _, tt := range tests {
+		hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+		}))
+		h := &presendHook{url: hook.URL, client: hook.Client(), failOpen: tt.failOpen}
+		err := h.check(context.Background(), Message{From: "sender@example.com", To: []string{"admin@example.com"}})
+		hook.Close()
+
+		if (err != nil) != tt.wantErr || errors.Is(err, errPresendRejected) != tt.rejected {
+			t.Errorf("status %d, fail open %t: err = %v, want error %t, rejected %t", tt.status, tt.failOpen, err, tt.wantErr, tt.rejected)
+		}
+	}
+}
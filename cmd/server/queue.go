@@ -0,0 +1,181 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// queuedNotification is a payload, or a batch sent as one digest, waiting for a background worker.
+type queuedNotification struct {
+	payload *WebhookPayload
+	digest  []WebhookPayload // Set instead of payload for a digest
+	sev     severity
+	due     time.Time // Ordering key: arrival time moved earlier by aging per severity level
+}
+
+// notificationHeap orders queued notifications by due time, earliest first.
+type notificationHeap []*queuedNotification
+
+func (h notificationHeap) Len() int           { return len(h) }
+func (h notificationHeap) Less(i, j int) bool { return h[i].due.Before(h[j].due) }
+func (h notificationHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *notificationHeap) Push(x any)        { *h = append(*h, x.(*queuedNotification)) }
+func (h *notificationHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// notificationQueue feeds background sends to a fixed pool of workers, most severe first.
+// Each severity level counts as aging worth of waiting, so a success notification that
+// has waited longer than aging beats a freshly queued warning and is never starved.
+// A nil *notificationQueue is empty.
+type notificationQueue struct {
+	workers int
+	aging   time.Duration
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	items  notificationHeap
+	depth  map[severity]int
+	closed bool
+	done   sync.WaitGroup
+}
+
+// loadNotificationQueue reads QUEUE_WORKERS (default 4) and QUEUE_AGING (default 1m).
+func loadNotificationQueue() (*notificationQueue, error) {
+	q := &notificationQueue{workers: 4, aging: time.Minute, depth: make(map[severity]int)}
+	q.cond = sync.NewCond(&q.mu)
+
+	if v := os.Getenv("QUEUE_WORKERS"); v != "" {
+		workers, err := strconv.Atoi(v)
+		if err != nil || workers < 1 {
+			return nil, fmt.Errorf("invalid QUEUE_WORKERS %q: must be a positive integer", v)
+		}
+		q.workers = workers
+	}
+	if v := os.Getenv("QUEUE_AGING"); v != "" {
+		aging, err := time.ParseDuration(v)
+		if err != nil || aging < 0 {
+			return nil, fmt.Errorf("invalid QUEUE_AGING %q: must be a non-negative duration", v)
+		}
+		q.aging = aging
+	}
+	return q, nil
+}
+
+// start runs the workers, each calling handle for one notification, or handleDigest for
+// one digest, at a time.
+func (q *notificationQueue) start(handle func(*WebhookPayload), handleDigest func([]WebhookPayload)) {
+	for range q.workers {
+		q.done.Add(1)
+		go func() {
+			defer q.done.Done()
+			for {
+				item := q.pop()
+				if item == nil {
+					return
+				}
+				if item.digest != nil {
+					handleDigest(item.digest)
+				} else {
+					handle(item.payload)
+				}
+			}
+		}()
+	}
+}
+
+// errQueueClosed is returned by push once the queue has stopped accepting work.
+var errQueueClosed = errors.New("notification queue is closed")
+
+// push queues payload for a worker, prioritized by sev, the severity of the payload as the
+// transform rules leave it. Once the queue is closed it refuses payloads with errQueueClosed,
+// since no worker would be left to send them.
+func (q *notificationQueue) push(payload *WebhookPayload, sev severity) error {
+	return q.enqueue(&queuedNotification{payload: payload, sev: sev})
+}
+
+// pushAll queues each of payloads as push does, with the matching severity of sevs. Either
+// all of them are queued or, once the queue is closed, none.
+func (q *notificationQueue) pushAll(payloads []*WebhookPayload, sevs []severity) error {
+	items := make([]*queuedNotification, len(payloads))
+	for i, payload := range payloads {
+		items[i] = &queuedNotification{payload: payload, sev: sevs[i]}
+	}
+	return q.enqueue(items...)
+}
+
+// pushDigest queues payloads to be sent as one digest, prioritized by sev, the severity of
+// its most severe notification.
+func (q *notificationQueue) pushDigest(payloads []WebhookPayload, sev severity) error {
+	return q.enqueue(&queuedNotification{digest: payloads, sev: sev})
+}
+
+// enqueue adds items to the queue, aged by severity, unless it's closed.
+func (q *notificationQueue) enqueue(items ...*queuedNotification) error {
+	now := time.Now()
+	for _, item := range items {
+		item.due = now.Add(-time.Duration(item.sev) * q.aging)
+	}
+
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return errQueueClosed
+	}
+	for _, item := range items {
+		heap.Push(&q.items, item)
+		q.depth[item.sev]++
+	}
+	q.mu.Unlock()
+	q.cond.Broadcast()
+	return nil
+}
+
+// pop waits for the next notification, returning nil once the queue is closed and empty.
+func (q *notificationQueue) pop() *queuedNotification {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.items) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.items) == 0 {
+		return nil
+	}
+	item := heap.Pop(&q.items).(*queuedNotification)
+	q.depth[item.sev]--
+	return item
+}
+
+// close stops accepting work and waits for the workers to drain the queue.
+func (q *notificationQueue) close() {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+	q.done.Wait()
+}
+
+// depths returns the number of queued notifications per severity.
+func (q *notificationQueue) depths() map[string]int {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	depths := make(map[string]int, len(severities))
+	for _, sev := range severities {
+		depths[sev.String()] = q.depth[sev]
+	}
+	return depths
+}
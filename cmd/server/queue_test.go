@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestQueuePrioritizesTransformedPayload(t *testing.T) {
+	rulesPath := filepath.Join(t.TempDir(), "rules.txt")
+	// A success copied to the archive share still needs attention
+	if err := os.WriteFile(rulesPath, []byte("Status = Destination == `\\\\archive\\share` ? \"Failed\" : Status\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	transforms, err := loadTransformRules(rulesPath)
+	if err != nil {
+		t.Fatalf("loadTransformRules: %v", err)
+	}
+
+	n, _ := newTestNotifier()
+	n.transforms = transforms
+	// Not started, so the notification stays queued
+	if n.queue, err = loadNotificationQueue(); err != nil {
+		t.Fatalf("loadNotificationQueue: %v", err)
+	}
+	app := fiber.New()
+	registerRoutes(app, n, nil, nil)
+
+	req := httptest.NewRequest(fiber.MethodPost, "/webhook/robocopy-failure", strings.NewReader(`{"status":"Success","exitCode":1,"destination":"\\\\archive\\share","emailContent":"Copied"}`))
+	req.Header.Set("Content-Type", fiber.MIMEApplicationJSON)
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test: %v", err)
+	}
+	if resp.StatusCode != fiber.StatusAccepted {
+		t.Fatalf("status = %d, want 202", resp.StatusCode)
+	}
+	if depths := n.queue.depths(); depths[severityFailure.String()] != 1 {
+		t.Errorf("queue depths = %v, want the notification queued as a failure", depths)
+	}
+}
+
+func TestQueuePushAfterClose(t *testing.T) {
+	q, err := loadNotificationQueue()
+	if err != nil {
+		t.Fatalf("loadNotificationQueue: %v", err)
+	}
+	var handled []*WebhookPayload
+	q.start(func(p *WebhookPayload) { handled = append(handled, p) }, nil)
+	q.close()
+
+	if err := q.push(&WebhookPayload{Status: "Failed"}, severityFailure); !errors.Is(err, errQueueClosed) {
+		t.Errorf("push after close: err = %v, want errQueueClosed", err)
+	}
+	if len(handled) != 0 || len(q.items) != 0 {
+		t.Errorf("the refused payload was handled or kept: %d handled, %d queued", len(handled), len(q.items))
+	}
+}
+
+// refusingSender rejects every message, as a relay refusing the recipients would.
+type refusingSender struct{}
+
+func (refusingSender) Send(ctx context.Context, m Message) error {
+	return &textproto.Error{Code: 550, Msg: "Mailbox unavailable"}
+}
+
+func TestBatchAlwaysAccept(t *testing.T) {
+	n, _ := newTestNotifier()
+	n.sender = refusingSender{}
+	var err error
+	if n.queue, err = loadNotificationQueue(); err != nil {
+		t.Fatalf("loadNotificationQueue: %v", err)
+	}
+	n.deadLetters = &deadLetters{path: filepath.Join(t.TempDir(), "dead-letter.jsonl")}
+	n.queue.start(n.notifyInBackground, n.notifyDigestInBackground)
+	app := fiber.New()
+	registerRoutes(app, n, nil, nil)
+
+	batch := `[{"status":"Failed","exitCode":8,"emailContent":"One"},{"status":"Success","exitCode":1,"emailContent":"Two"}]`
+	for _, path := range []string{"/webhook/batch", "/webhook/batch?digest=true"} {
+		req := httptest.NewRequest(fiber.MethodPost, path, strings.NewReader(batch))
+		req.Header.Set("Content-Type", fiber.MIMEApplicationJSON)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test: %v", err)
+		}
+		if resp.StatusCode != fiber.StatusAccepted {
+			t.Errorf("%s: status = %d, want 202 though every send fails", path, resp.StatusCode)
+		}
+	}
+	n.queue.close()
+
+	letters, err := os.ReadFile(n.deadLetters.path)
+	if err != nil {
+		t.Fatalf("reading dead letters: %v", err)
+	}
+	// Both notifications, once sent on their own and once in the digest
+	if lines := bytes.Count(letters, []byte("\n")); lines != 4 {
+		t.Errorf("kept %d dead letters, want 4:\n%s", lines, letters)
+	}
+}
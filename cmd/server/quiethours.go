@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// deferredMessage is a notification held back during quiet hours or until its deliverAt time.
+type deferredMessage struct {
+	To          []string     `json:"to"`
+	From        string       `json:"from,omitempty"` // Empty for messages held before sender routes existed
+	Relay       string       `json:"relay,omitempty"`
+	Subject     string       `json:"subject"`
+	Body        string       `json:"body"`
+	HTML        string       `json:"html,omitempty"`   // Dropped when combined into a digest
+	Banner      bool         `json:"banner,omitempty"` // Render HTML with the banner of Severity when sent
+	Severity    severity     `json:"severity,omitempty"`
+	Attachments []attachment `json:"attachments,omitempty"` // Dropped when combined into a digest
+	Manageable  bool         `json:"manageable,omitempty"`
+	Received    time.Time    `json:"received"`
+	DeliverAt   time.Time    `json:"deliverAt,omitzero"` // Only set for scheduled sends
+}
+
+// quietHours holds non-fatal notifications during a daily window and delivers them in
+// batches once it ends. Held messages are persisted so a restart doesn't lose them.
+// A nil *quietHours is never active.
+type quietHours struct {
+	start, end time.Duration // Offsets from local midnight
+	loc        *time.Location
+	storePath  string
+
+	mu       sync.Mutex
+	deferred []deferredMessage
+}
+
+// loadQuietHours reads QUIET_HOURS (e.g. "22:00-07:00"), QUIET_HOURS_TZ and QUIET_HOURS_STORE.
+// It returns nil when quiet hours aren't configured.
+func loadQuietHours() (*quietHours, error) {
+	window := os.Getenv("QUIET_HOURS")
+	if window == "" {
+		return nil, nil
+	}
+
+	startText, endText, ok := strings.Cut(window, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid QUIET_HOURS %q: expected HH:MM-HH:MM", window)
+	}
+	start, err := parseClock(startText)
+	if err != nil {
+		return nil, fmt.Errorf("invalid QUIET_HOURS %q: %w", window, err)
+	}
+	end, err := parseClock(endText)
+	if err != nil {
+		return nil, fmt.Errorf("invalid QUIET_HOURS %q: %w", window, err)
+	}
+
+	loc := time.Local
+	if tz := os.Getenv("QUIET_HOURS_TZ"); tz != "" {
+		if loc, err = time.LoadLocation(tz); err != nil {
+			return nil, fmt.Errorf("invalid QUIET_HOURS_TZ %q: %w", tz, err)
+		}
+	}
+
+	q := &quietHours{start: start, end: end, loc: loc, storePath: os.Getenv("QUIET_HOURS_STORE")}
+	if q.storePath == "" {
+		q.storePath = "deferred.json"
+	}
+
+	// Pick up anything held before a restart
+	if q.deferred, err = readDeferred(q.storePath); err != nil {
+		return nil, fmt.Errorf("invalid QUIET_HOURS_STORE: %w", err)
+	}
+	if len(q.deferred) > 0 {
+		log.Printf("Loaded %d deferred notifications from %s", len(q.deferred), q.storePath)
+	}
+	return q, nil
+}
+
+// readDeferred loads the messages persisted at path, which need not exist yet.
+func readDeferred(path string) ([]deferredMessage, error) {
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var msgs []deferredMessage
+	if err := json.Unmarshal(data, &msgs); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return msgs, nil
+}
+
+// writeDeferred persists msgs to path, replacing what was there.
+func writeDeferred(path string, msgs []deferredMessage) error {
+	data, err := json.Marshal(msgs)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so a crash never leaves a truncated store
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("writing deferred notifications: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("writing deferred notifications: %w", err)
+	}
+	return nil
+}
+
+// parseClock parses an HH:MM time of day into an offset from midnight.
+func parseClock(text string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(text))
+	if err != nil {
+		return 0, fmt.Errorf("%q is not an HH:MM time", text)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// active reports whether now falls inside the quiet window. Windows may span midnight.
+func (q *quietHours) active(now time.Time) bool {
+	if q == nil {
+		return false
+	}
+	now = now.In(q.loc)
+	offset := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute
+	if q.start <= q.end {
+		return offset >= q.start && offset < q.end
+	}
+	return offset >= q.start || offset < q.end
+}
+
+// hold defers msg until the quiet window ends, persisting it first.
+func (q *quietHours) hold(msg deferredMessage) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.deferred = append(q.deferred, msg)
+	if err := q.persist(); err != nil {
+		q.deferred = q.deferred[:len(q.deferred)-1]
+		return err
+	}
+	return nil
+}
+
+// persist writes the deferred messages to the store. The caller must hold q.mu.
+func (q *quietHours) persist() error {
+	return writeDeferred(q.storePath, q.deferred)
+}
+
+// run checks the window every minute until ctx is cancelled, handing held messages to
+// flush once quiet hours are over. Messages flush reports as undelivered stay held.
+func (q *quietHours) run(ctx context.Context, flush func(ctx context.Context, msgs []deferredMessage) []deferredMessage) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		if !q.active(time.Now()) {
+			q.mu.Lock()
+			pending := q.deferred
+			q.mu.Unlock()
+
+			if len(pending) > 0 {
+				log.Printf("Quiet hours over, delivering %d deferred notifications", len(pending))
+				failed := flush(ctx, pending)
+
+				// Keep anything that failed plus anything held while we were flushing
+				q.mu.Lock()
+				q.deferred = append(failed, q.deferred[len(pending):]...)
+				if err := q.persist(); err != nil {
+					log.Printf("Error saving deferred notifications: %v", err)
+				}
+				q.mu.Unlock()
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
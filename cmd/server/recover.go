@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"runtime/debug"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// recoverPanics recovers a panic in the handlers after it, logging it with its stack
+// trace as one JSON line and answering 500 with the request ID to correlate it by, on
+// every endpoint.
+func recoverPanics(c *fiber.Ctx) (err error) {
+	defer func() {
+		recovered := recover()
+		if recovered == nil {
+			return
+		}
+		// Only the webhook endpoints run the requestid middleware, so a panic elsewhere gets
+		// an ID of its own, the caller's if it sent one
+		id := requestID(c)
+		if id == "" {
+			if id = c.Get(fiber.HeaderXRequestID); id == "" {
+				id = utils.UUID()
+			}
+			c.Set(fiber.HeaderXRequestID, id)
+		}
+		var entry bytes.Buffer
+		enc := json.NewEncoder(&entry)
+		enc.SetEscapeHTML(false)
+		enc.Encode(map[string]any{
+			"panic":     fmt.Sprint(recovered),
+			"method":    c.Method(),
+			"path":      c.Path(),
+			"requestId": id,
+			"stack":     string(debug.Stack()),
+		})
+		log.Printf("Recovered from panic: %s", bytes.TrimSpace(entry.Bytes()))
+
+		err = respond(c, fiber.StatusInternalServerError, fiber.Map{
+			"error":     "Internal server error",
+			"requestId": id,
+		})
+	}()
+	return c.Next()
+}
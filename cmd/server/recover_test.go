@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
+)
+
+func TestRecoverPanicsRequestID(t *testing.T) {
+	app := fiber.New()
+	app.Use(recoverPanics)
+	fail := func(c *fiber.Ctx) error { panic("handler bug") }
+	app.Post("/webhook", requestid.New(), fail)
+	app.Post("/admin", fail)
+
+	for _, tt := range []struct{ path, sent string }{
+		{"/webhook", ""},
+		{"/webhook", "caller-id"},
+		{"/admin", ""},
+		{"/admin", "caller-id"},
+	} {
+		req := httptest.NewRequest(fiber.MethodPost, tt.path, nil)
+		if tt.sent != "" {
+			req.Header.Set(fiber.HeaderXRequestID, tt.sent)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test: %v", err)
+		}
+		var body struct {
+			RequestID string `json:"requestId"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		header := resp.Header.Get(fiber.HeaderXRequestID)
+		if resp.StatusCode != fiber.StatusInternalServerError || body.RequestID == "" || body.RequestID != header {
+			t.Errorf("%s: status %d, requestId %q, X-Request-ID %q; want 500 with the same ID in both", tt.path, resp.StatusCode, body.RequestID, header)
+		}
+		if tt.sent != "" && body.RequestID != tt.sent {
+			t.Errorf("%s: requestId = %q, want the caller's %q", tt.path, body.RequestID, tt.sent)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// respond writes body with the given status, as plain text when the client's Accept
+// header prefers it and as JSON otherwise.
+func respond(c *fiber.Ctx, status int, body fiber.Map) error {
+	c.Status(status)
+	if c.Accepts(fiber.MIMEApplicationJSON, fiber.MIMETextPlain) != fiber.MIMETextPlain {
+		return c.JSON(body)
+	}
+
+	keys := make([]string, 0, len(body))
+	for key := range body {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, key := range keys {
+		fmt.Fprintf(&b, "%s: %v\n", key, body[key])
+	}
+	c.Set(fiber.HeaderContentType, fiber.MIMETextPlainCharsetUTF8)
+	return c.SendString(b.String())
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// defaultRetryOn is the set of failure classes retried when RETRY_ON is unset.
+const defaultRetryOn = "timeout,connection,4xx"
+
+// retryPolicy decides whether and how often a failed send is retried.
+type retryPolicy struct {
+	maxAttempts  int
+	baseDelay    time.Duration
+	maxDelay     time.Duration // Caps the delay between attempts
+	totalTimeout time.Duration // Bounds the whole retry sequence; zero means no bound
+	retryOn      map[string]bool
+
+	// greylistDelay is the minimum wait after a greylisting reply. Servers reject the first
+	// attempt from an unknown sender for minutes, so the usual backoff would waste attempts.
+	// Zero treats greylisting replies like any other.
+	greylistDelay time.Duration
+}
+
+// greylistCodes are the temporary SMTP replies greylisting servers answer first attempts with.
+var greylistCodes = map[int]bool{421: true, 450: true, 451: true}
+
+// greylisted reports whether err is a greylisting reply.
+func greylisted(err error) bool {
+	var smtpErr *textproto.Error
+	return errors.As(err, &smtpErr) && greylistCodes[smtpErr.Code]
+}
+
+// loadRetryPolicy reads the retry policy from RETRY_MAX_ATTEMPTS, RETRY_BASE_DELAY,
+// RETRY_MAX_DELAY, RETRY_TOTAL_TIMEOUT and RETRY_ON.
+func loadRetryPolicy() (retryPolicy, error) {
+	policy := retryPolicy{maxAttempts: 3, baseDelay: time.Second, maxDelay: 30 * time.Second, totalTimeout: 2 * time.Minute, greylistDelay: time.Minute}
+
+	if v := os.Getenv("RETRY_MAX_ATTEMPTS"); v != "" {
+		attempts, err := strconv.Atoi(v)
+		if err != nil || attempts < 1 {
+			return retryPolicy{}, fmt.Errorf("invalid RETRY_MAX_ATTEMPTS %q: must be a positive integer", v)
+		}
+		policy.maxAttempts = attempts
+	}
+	if v := os.Getenv("RETRY_BASE_DELAY"); v != "" {
+		delay, err := time.ParseDuration(v)
+		if err != nil {
+			return retryPolicy{}, fmt.Errorf("invalid RETRY_BASE_DELAY %q: %w", v, err)
+		}
+		policy.baseDelay = delay
+	}
+	if v := os.Getenv("RETRY_MAX_DELAY"); v != "" {
+		delay, err := time.ParseDuration(v)
+		if err != nil {
+			return retryPolicy{}, fmt.Errorf("invalid RETRY_MAX_DELAY %q: %w", v, err)
+		}
+		policy.maxDelay = delay
+	}
+	if v := os.Getenv("RETRY_TOTAL_TIMEOUT"); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil {
+			return retryPolicy{}, fmt.Errorf("invalid RETRY_TOTAL_TIMEOUT %q: %w", v, err)
+		}
+		policy.totalTimeout = timeout
+	}
+
+	if v := os.Getenv("GREYLIST_RETRY_DELAY"); v != "" {
+		delay, err := time.ParseDuration(v)
+		if err != nil || delay < 0 {
+			return retryPolicy{}, fmt.Errorf("invalid GREYLIST_RETRY_DELAY %q: must be a non-negative duration", v)
+		}
+		policy.greylistDelay = delay
+	}
+
+	retryOn := os.Getenv("RETRY_ON")
+	if retryOn == "" {
+		retryOn = defaultRetryOn
+	}
+	classes, err := parseRetryOn(retryOn)
+	if err != nil {
+		return retryPolicy{}, err
+	}
+	policy.retryOn = classes
+	return policy, nil
+}
+
+// parseRetryOn parses a comma-separated list of failure classes. Accepted entries are
+// "timeout", "connection", "4xx", "5xx" and individual three-digit SMTP reply codes.
+func parseRetryOn(list string) (map[string]bool, error) {
+	classes := make(map[string]bool)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		switch entry {
+		case "timeout", "connection", "4xx", "5xx":
+		default:
+			if code, err := strconv.Atoi(entry); err != nil || code < 400 || code > 599 {
+				return nil, fmt.Errorf("invalid RETRY_ON entry %q: expected timeout, connection, 4xx, 5xx or an SMTP reply code", entry)
+			}
+		}
+		classes[entry] = true
+	}
+	return classes, nil
+}
+
+// errorClasses returns the failure classes err belongs to.
+func errorClasses(err error) []string {
+	var classes []string
+
+	var smtpErr *textproto.Error
+	if errors.As(err, &smtpErr) {
+		classes = append(classes, strconv.Itoa(smtpErr.Code))
+		switch smtpErr.Code / 100 {
+		case 4:
+			classes = append(classes, "4xx")
+		case 5:
+			classes = append(classes, "5xx")
+		}
+		return classes
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		classes = append(classes, "timeout")
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) || errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) {
+		classes = append(classes, "connection")
+	}
+	return classes
+}
+
+// retryable reports whether err falls into one of the policy's retried classes.
+// Greylisting replies are always retried unless greylistDelay is zero.
+func (p retryPolicy) retryable(err error) bool {
+	if p.greylistDelay > 0 && greylisted(err) {
+		return true
+	}
+	for _, class := range errorClasses(err) {
+		if p.retryOn[class] {
+			return true
+		}
+	}
+	return false
+}
+
+// attemptsError is a failed send together with the number of attempts it took.
+type attemptsError struct {
+	attempts int
+	err      error // The error of the last attempt
+}
+
+func (e *attemptsError) Error() string { return e.err.Error() }
+func (e *attemptsError) Unwrap() error { return e.err }
+
+// sendAttempts returns how many attempts the failed send err made, and the error of the
+// last one. Errors that weren't retried count as a single attempt.
+func sendAttempts(err error) (int, error) {
+	var attemptsErr *attemptsError
+	if errors.As(err, &attemptsErr) {
+		return attemptsErr.attempts, attemptsErr.err
+	}
+	return 1, err
+}
+
+// transient reports whether err is a failure that may well succeed later: a temporary
+// SMTP reply, a timeout or a connection problem.
+func transient(err error) bool {
+	for _, class := range errorClasses(err) {
+		if class == "4xx" || class == "timeout" || class == "connection" {
+			return true
+		}
+	}
+	return false
+}
+
+// do calls fn until it succeeds, returns a non-retryable error, the attempts run out
+// or ctx is cancelled. The delay between attempts doubles each time, starting at baseDelay
+// and capped at maxDelay, and the whole sequence is abandoned after totalTimeout.
+func (p retryPolicy) do(ctx context.Context, fn func(ctx context.Context) error) error {
+	parent := ctx
+	if p.totalTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.totalTimeout)
+		defer cancel()
+	}
+
+	delay := p.baseDelay
+	var err error
+	attempt := 1
+	for ; attempt <= p.maxAttempts; attempt++ {
+		err = fn(ctx)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if !p.retryable(err) {
+			log.Printf("Attempt %d failed with non-retryable error: %v", attempt, err)
+			return &attemptsError{attempt, err}
+		}
+		if attempt < p.maxAttempts {
+			if p.maxDelay > 0 && delay > p.maxDelay {
+				delay = p.maxDelay
+			}
+			wait := delay
+			if p.greylistDelay > 0 && greylisted(err) {
+				wait = max(wait, p.greylistDelay)
+				log.Printf("Attempt %d/%d looks greylisted: %v. Retrying in %s...", attempt, p.maxAttempts, err, wait)
+			} else {
+				log.Printf("Attempt %d/%d failed: %v. Retrying in %s...", attempt, p.maxAttempts, err, wait)
+			}
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+			}
+			if ctx.Err() != nil {
+				break
+			}
+			delay *= 2
+		}
+	}
+
+	attempt = min(attempt, p.maxAttempts)
+	if ctx.Err() != nil && parent.Err() == nil {
+		return fmt.Errorf("retries abandoned after %s: %w", p.totalTimeout, &attemptsError{attempt, err})
+	}
+	return &attemptsError{attempt, err}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// alwaysTemporary is a send that fails with a temporary SMTP reply every time, counting
+// its attempts.
+type alwaysTemporary struct {
+	attempts int
+}
+
+func (f *alwaysTemporary) send(ctx context.Context) error {
+	f.attempts++
+	return &textproto.Error{Code: 452, Msg: "Insufficient system storage"}
+}
+
+func TestRetryTotalTimeout(t *testing.T) {
+	policy := retryPolicy{
+		maxAttempts:  1000,
+		baseDelay:    10 * time.Millisecond,
+		maxDelay:     20 * time.Millisecond,
+		totalTimeout: 100 * time.Millisecond,
+		retryOn:      map[string]bool{"4xx": true},
+	}
+	fake := &alwaysTemporary{}
+
+	start := time.Now()
+	err := policy.do(context.Background(), fake.send)
+	elapsed := time.Since(start)
+
+	if err == nil || !strings.Contains(err.Error(), "retries abandoned") {
+		t.Fatalf("err = %v, want retries abandoned", err)
+	}
+	if elapsed > policy.totalTimeout+50*time.Millisecond {
+		t.Errorf("retries took %s, want at most about %s", elapsed, policy.totalTimeout)
+	}
+	if fake.attempts < 2 {
+		t.Errorf("made %d attempts, want retries within the timeout", fake.attempts)
+	}
+	if attempts, _ := sendAttempts(err); attempts != fake.attempts {
+		t.Errorf("reported %d attempts, made %d", attempts, fake.attempts)
+	}
+}
+
+func TestRetryMaxDelay(t *testing.T) {
+	policy := retryPolicy{
+		maxAttempts: 4,
+		baseDelay:   10 * time.Millisecond,
+		maxDelay:    15 * time.Millisecond,
+		retryOn:     map[string]bool{"4xx": true},
+	}
+	fake := &alwaysTemporary{}
+
+	start := time.Now()
+	err := policy.do(context.Background(), fake.send)
+	elapsed := time.Since(start)
+
+	if err == nil || fake.attempts != policy.maxAttempts {
+		t.Fatalf("err = %v after %d attempts, want a failure after %d", err, fake.attempts, policy.maxAttempts)
+	}
+	// Waits of 10ms, then 15ms twice instead of 20ms and 40ms
+	if want := 40 * time.Millisecond; elapsed < want || elapsed > want+50*time.Millisecond {
+		t.Errorf("retries took %s, want about %s", elapsed, want)
+	}
+}
+
+func TestRetryHonorsCancellation(t *testing.T) {
+	policy := retryPolicy{
+		maxAttempts: 1000,
+		baseDelay:   time.Hour,
+		retryOn:     map[string]bool{"4xx": true},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := policy.do(ctx, (&alwaysTemporary{}).send)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("retries took %s after the context was cancelled", elapsed)
+	}
+	var attemptsErr *attemptsError
+	if !errors.As(err, &attemptsErr) || attemptsErr.attempts != 1 {
+		t.Errorf("err = %v, want the failure of the single attempt", err)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// robocopyCounts holds one row of the robocopy summary table. Rows that robocopy
+// does not report a column for (e.g. Skipped on the Times row) leave it empty.
+type robocopyCounts struct {
+	Total    string
+	Copied   string
+	Skipped  string
+	Mismatch string
+	Failed   string
+	Extras   string
+}
+
+// robocopySummary holds the figures from the summary table at the end of a robocopy log.
+type robocopySummary struct {
+	Dirs  robocopyCounts
+	Files robocopyCounts
+	Bytes robocopyCounts
+	Times robocopyCounts
+}
+
+// summaryRowLabels maps the (lowercased) row labels robocopy prints in the languages
+// we have seen in the wild to the row they represent.
+var summaryRowLabels = map[string]string{
+	"dirs": "dirs", "verz.": "dirs", "verzeichnisse": "dirs", "rép": "dirs", "rép.": "dirs", "rep": "dirs", "dir.": "dirs", "directorios": "dirs",
+	"files": "files", "dateien": "files", "fichiers": "files", "archivos": "files",
+	"bytes": "bytes", "octets": "bytes",
+	"times": "times", "zeiten": "times", "heures": "times", "tiempos": "times",
+}
+
+var (
+	summaryLinePattern  = regexp.MustCompile(`^\s*([^\s:][^:]*?)\s*:\s*(.+)$`)
+	summaryValuePattern = regexp.MustCompile(`^\d+([.,]\d+)?$`)
+	summaryTimePattern  = regexp.MustCompile(`^\d+:\d{2}:\d{2}$`)
+	summaryUnitPattern  = regexp.MustCompile(`^[kmgt]$`)
+)
+
+// parseRobocopySummary extracts the summary table from a robocopy log. It returns nil
+// when the content doesn't contain a table in a format we recognize.
+func parseRobocopySummary(content string) *robocopySummary {
+	summary := &robocopySummary{}
+	found := map[string]bool{}
+
+	for _, line := range strings.Split(content, "\n") {
+		match := summaryLinePattern.FindStringSubmatch(strings.TrimRight(line, "\r"))
+		if match == nil {
+			continue
+		}
+		row, ok := summaryRowLabels[strings.ToLower(match[1])]
+		if !ok {
+			continue
+		}
+		values, ok := summaryValues(match[2], row == "times")
+		if !ok {
+			// Header lines such as "Files : *.*" share labels with the table; skip them.
+			continue
+		}
+
+		// The summary is printed last, so later rows win over anything earlier in the log
+		switch row {
+		case "dirs":
+			summary.Dirs = countsFromValues(values)
+		case "files":
+			summary.Files = countsFromValues(values)
+		case "bytes":
+			summary.Bytes = countsFromValues(values)
+		case "times":
+			// Times only reports Total, Copied, Failed and Extras
+			summary.Times = robocopyCounts{Total: values[0], Copied: values[1], Failed: values[2], Extras: values[3]}
+		}
+		found[row] = true
+	}
+
+	if !found["dirs"] || !found["files"] {
+		return nil
+	}
+	return summary
+}
+
+// summaryValues splits the value columns of a summary row, joining byte figures with
+// their unit suffix (e.g. "1.23 m"). It reports false if the row isn't a table row.
+func summaryValues(raw string, times bool) ([]string, bool) {
+	fields := strings.Fields(raw)
+	var values []string
+	for i := 0; i < len(fields); i++ {
+		field := fields[i]
+		switch {
+		case times && summaryTimePattern.MatchString(field):
+			values = append(values, field)
+		case !times && summaryValuePattern.MatchString(field):
+			if i+1 < len(fields) && summaryUnitPattern.MatchString(fields[i+1]) {
+				field += " " + fields[i+1]
+				i++
+			}
+			values = append(values, field)
+		default:
+			return nil, false
+		}
+	}
+
+	if (times && len(values) != 4) || (!times && len(values) != 6) {
+		return nil, false
+	}
+	return values, true
+}
+
+// countsFromValues maps the six value columns of a Dirs/Files/Bytes row.
+func countsFromValues(values []string) robocopyCounts {
+	return robocopyCounts{
+		Total:    values[0],
+		Copied:   values[1],
+		Skipped:  values[2],
+		Mismatch: values[3],
+		Failed:   values[4],
+		Extras:   values[5],
+	}
+}
+
+// table renders the summary as a fixed-width plain text table.
+func (s *robocopySummary) table() string {
+	var b strings.Builder
+	b.WriteString("Robocopy Summary\r\n")
+	fmt.Fprintf(&b, "%-6s %10s %10s %10s %10s %10s %10s\r\n", "", "Total", "Copied", "Skipped", "Mismatch", "Failed", "Extras")
+	for _, row := range []struct {
+		label  string
+		counts robocopyCounts
+	}{
+		{"Dirs", s.Dirs},
+		{"Files", s.Files},
+		{"Bytes", s.Bytes},
+		{"Times", s.Times},
+	} {
+		c := row.counts
+		if c.Total == "" {
+			continue
+		}
+		fmt.Fprintf(&b, "%-6s %10s %10s %10s %10s %10s %10s\r\n", row.label, c.Total, c.Copied, c.Skipped, c.Mismatch, c.Failed, c.Extras)
+	}
+	return b.String()
+}
+
+// logFields renders the summary as key=value pairs for structured log lines.
+func (s *robocopySummary) logFields() string {
+	var fields []string
+	for _, row := range []struct {
+		label  string
+		counts robocopyCounts
+	}{
+		{"dirs", s.Dirs},
+		{"files", s.Files},
+		{"bytes", s.Bytes},
+	} {
+		c := row.counts
+		if c.Total == "" {
+			continue
+		}
+		fields = append(fields,
+			fmt.Sprintf("%s_total=%q", row.label, c.Total),
+			fmt.Sprintf("%s_copied=%q", row.label, c.Copied),
+			fmt.Sprintf("%s_skipped=%q", row.label, c.Skipped),
+			fmt.Sprintf("%s_mismatch=%q", row.label, c.Mismatch),
+			fmt.Sprintf("%s_failed=%q", row.label, c.Failed),
+			fmt.Sprintf("%s_extras=%q", row.label, c.Extras),
+		)
+	}
+	if s.Times.Total != "" {
+		fields = append(fields, fmt.Sprintf("times_total=%q", s.Times.Total))
+	}
+	return strings.Join(fields, " ")
+}
+
+// collapseBlankLines replaces runs of three or more blank lines in content, which robocopy
+// logs are full of, with a single blank line. Shorter runs are left as they are.
+func collapseBlankLines(content string) string {
+	lines := strings.SplitAfter(content, "\n")
+	var b strings.Builder
+	for i := 0; i < len(lines); {
+		if strings.TrimSpace(lines[i]) != "" || i == len(lines)-1 {
+			b.WriteString(lines[i])
+			i++
+			continue
+		}
+		run := i
+		for run < len(lines)-1 && strings.TrimSpace(lines[run]) == "" {
+			run++
+		}
+		if run-i >= 3 {
+			b.WriteString(strings.TrimLeft(lines[i], " \t")) // Just the line ending
+		} else {
+			for _, line := range lines[i:run] {
+				b.WriteString(line)
+			}
+		}
+		i = run
+	}
+	return b.String()
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/compress"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
+)
+
+// namedMiddleware is a middleware that can be switched off by name.
+type namedMiddleware struct {
+	name    string
+	handler func() (fiber.Handler, error)
+}
+
+// webhookMiddleware lists the middleware applied to webhook endpoints, in the order
+// they run for each request, after the shutdown cancellation and panic recovery
+// registerRoutes puts in front of every endpoint:
+//
+//  1. tracing:     starts the request's server span when an OTLP endpoint is configured, so it covers everything below
+//  2. requestid:   assigns each request an X-Request-ID, keeping the caller's if it sent one
+//  3. errordelay:  delays error responses by ERROR_RESPONSE_DELAY, including those from later middleware
+//  4. inflight:    counts concurrent requests and sheds those beyond MAX_INFLIGHT, before any other work
+//  5. pause:       answers 503 while intake is paused with POST /admin/pause
+//  6. signature:   rejects requests without a valid HMAC signature when WEBHOOK_SECRET is set
+//  7. idempotency: replays the cached response for a repeated Idempotency-Key header
+//  8. timeout:     bounds the send by the caller's X-Timeout-Ms header, capped at MAX_REQUEST_TIMEOUT
+//
+// New middleware should be added here at the point in the order it needs to run. A
+// middleware that isn't configured returns a nil handler and is left out.
+var webhookMiddleware = []namedMiddleware{
+	{"tracing", newTracingMiddleware},
+	{"requestid", newRequestIDMiddleware},
+	{"errordelay", newErrorDelayMiddleware},
+	{"inflight", newInFlightMiddleware},
+	{"pause", newPauseMiddleware},
+	{"signature", newSignatureMiddleware},
+	{"idempotency", newIdempotencyMiddleware},
+	{"timeout", newTimeoutMiddleware},
+}
+
+// validateMiddleware names the webhook middleware /validate runs. Validation has no side
+// effects, so shedding, pausing, error delays and idempotency don't apply to it.
+var validateMiddleware = []string{"requestid", "signature"}
+
+// loadWebhookMiddleware builds the webhook middleware chain, or only the named middleware
+// of it, leaving out any named in the comma-separated DISABLED_MIDDLEWARE setting.
+func loadWebhookMiddleware(only ...string) ([]fiber.Handler, error) {
+	disabled := make(map[string]bool)
+	for _, name := range splitList(strings.ToLower(os.Getenv("DISABLED_MIDDLEWARE"))) {
+		known := slices.ContainsFunc(webhookMiddleware, func(m namedMiddleware) bool { return m.name == name })
+		if !known {
+			return nil, fmt.Errorf("unknown middleware %q in DISABLED_MIDDLEWARE", name)
+		}
+		disabled[name] = true
+	}
+
+	var chain []fiber.Handler
+	for _, m := range webhookMiddleware {
+		if len(only) > 0 && !slices.Contains(only, m.name) {
+			continue
+		}
+		if disabled[m.name] {
+			if len(only) == 0 {
+				log.Printf("Middleware %s is disabled", m.name)
+			}
+			continue
+		}
+		handler, err := m.handler()
+		if err != nil {
+			return nil, err
+		}
+		if handler != nil {
+			chain = append(chain, handler)
+		}
+	}
+	return chain, nil
+}
+
+// newInFlightMiddleware caps the number of webhook requests processed at once.
+func newInFlightMiddleware() (fiber.Handler, error) {
+	var maxInFlight int64
+	if v := os.Getenv("MAX_INFLIGHT"); v != "" {
+		parsed, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || parsed < 0 {
+			return nil, fmt.Errorf("invalid MAX_INFLIGHT %q: must be a non-negative integer", v)
+		}
+		maxInFlight = parsed
+	}
+	return inFlightLimiter(maxInFlight), nil
+}
+
+// newPauseMiddleware lets operators stop webhook intake during maintenance.
+func newPauseMiddleware() (fiber.Handler, error) {
+	return rejectWhilePaused, nil
+}
+
+// newIdempotencyMiddleware remembers responses by Idempotency-Key so client retries
+// don't send duplicate emails.
+func newIdempotencyMiddleware() (fiber.Handler, error) {
+	ttl := 24 * time.Hour
+	if v := os.Getenv("IDEMPOTENCY_TTL"); v != "" {
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IDEMPOTENCY_TTL %q: %w", v, err)
+		}
+		ttl = parsed
+	}
+	return newIdempotencyStore(ttl).middleware(), nil
+}
+
+// newTimeoutMiddleware honors X-Timeout-Ms up to MAX_REQUEST_TIMEOUT (default 2m).
+func newTimeoutMiddleware() (fiber.Handler, error) {
+	max := 2 * time.Minute
+	if v := os.Getenv("MAX_REQUEST_TIMEOUT"); v != "" {
+		parsed, err := time.ParseDuration(v)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid MAX_REQUEST_TIMEOUT %q: must be a positive duration", v)
+		}
+		max = parsed
+	}
+	return requestTimeout(max), nil
+}
+
+// newRequestIDMiddleware tags requests with an ID that is echoed in responses and logs.
+func newRequestIDMiddleware() (fiber.Handler, error) {
+	return requestid.New(), nil
+}
+
+// requestID returns the ID assigned by the requestid middleware, or "" when it is disabled.
+func requestID(c *fiber.Ctx) string {
+	id, _ := c.Locals("requestid").(string)
+	return id
+}
+
+// registerRoutes wires every endpoint into app, putting webhook endpoints behind chain
+// and /validate behind validateChain.
+func registerRoutes(app *fiber.App, n *notifier, chain, validateChain []fiber.Handler) {
+	webhook := func(handlers ...fiber.Handler) []fiber.Handler {
+		return append(append([]fiber.Handler{}, chain...), handlers...)
+	}
+
+	// Give every handler a context that server shutdown cancels
+	app.Use(cancelOnShutdown)
+
+	// Read bodies within SERVER_BODY_LIMIT, leaving uploads to the endpoints that take
+	// them to stream
+	app.Use(limitRequestBody("/webhook/robocopy-failure", "/validate"))
+
+	// Keep a panicking handler, on any endpoint, from taking its stack trace with it
+	app.Use(recoverPanics)
+
+	// Compress every response for clients that accept it; fasthttp leaves bodies under
+	// 200 bytes alone, where compression would only add overhead
+	if os.Getenv("RESPONSE_COMPRESSION") == "true" {
+		app.Use(compress.New())
+	}
+
+	// Define the webhook endpoints
+	// ?debug=true answers with the rendered email instead of sending it, for operators only
+	app.Post("/webhook/robocopy-failure", webhook(requireAPIKeyWhen(debugRequested), n.webhookHandler)...)
+	app.Post("/webhook/batch", webhook(n.batchHandler)...)
+
+	// Check a payload as the webhook would, without sending
+	app.Post("/validate", append(append([]fiber.Handler{}, validateChain...), n.validateHandler)...)
+
+	// Expose in-memory counters and liveness for operators
+	app.Get("/stats", stats.handler)
+	app.Get("/healthz", healthHandler)
+	app.Get("/metrics", stats.metricsHandler)
+
+	// Operator endpoints that reveal configuration require the admin API key
+	app.Get("/config", requireAPIKey(), configHandler)
+	app.Get("/errors", requireAPIKey(), n.errors.handler)
+
+	// Recipients follow the signed links in heartbeats and digests to opt out
+	app.Get("/manage", n.mail.Manage.handler)
+	app.Post("/manage", n.mail.Manage.handler)
+
+	// Maintenance toggles for webhook intake
+	app.Post("/admin/pause", requireAPIKey(), pauseHandler)
+	app.Post("/admin/resume", requireAPIKey(), resumeHandler)
+}
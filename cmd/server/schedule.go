@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// scheduler holds notifications whose payload sets deliverAt until that time, so
+// low-priority reports can arrive at the start of the business day. Held messages are
+// persisted so a restart doesn't lose them. A nil *scheduler ignores deliverAt.
+type scheduler struct {
+	maxDelay  time.Duration // How far ahead deliverAt may be
+	storePath string
+
+	mu      sync.Mutex
+	pending []deferredMessage
+}
+
+// loadScheduler reads SCHEDULE_MAX_DELAY (default 72h, 0 disables scheduling) and
+// SCHEDULE_STORE (default scheduled.json).
+func loadScheduler() (*scheduler, error) {
+	maxDelay := 72 * time.Hour
+	if v := os.Getenv("SCHEDULE_MAX_DELAY"); v != "" {
+		parsed, err := time.ParseDuration(v)
+		if err != nil || parsed < 0 {
+			return nil, fmt.Errorf("invalid SCHEDULE_MAX_DELAY %q: must be a non-negative duration", v)
+		}
+		maxDelay = parsed
+	}
+	if maxDelay == 0 {
+		return nil, nil
+	}
+
+	s := &scheduler{maxDelay: maxDelay, storePath: os.Getenv("SCHEDULE_STORE")}
+	if s.storePath == "" {
+		s.storePath = "scheduled.json"
+	}
+	pending, err := readDeferred(s.storePath)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SCHEDULE_STORE: %w", err)
+	}
+	s.pending = pending
+	if len(pending) > 0 {
+		log.Printf("Loaded %d scheduled notifications from %s", len(pending), s.storePath)
+	}
+	return s, nil
+}
+
+// deliverAt returns when payload asked to be delivered, or the zero time to send it
+// now: without deliverAt, for fatal payloads, and when scheduling is off.
+func (s *scheduler) deliverAt(payload *WebhookPayload) (time.Time, error) {
+	if s == nil || payload.DeliverAt == "" || payloadSeverity(payload) >= severityFatal {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, payload.DeliverAt)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("deliverAt %q is not an RFC 3339 time", payload.DeliverAt)
+	}
+	if t.After(time.Now().Add(s.maxDelay)) {
+		return time.Time{}, fmt.Errorf("deliverAt %s is more than %s in the future", payload.DeliverAt, s.maxDelay)
+	}
+	return t, nil
+}
+
+// check rejects deliverAt values that can't be honored with 400.
+func (s *scheduler) check(payload *WebhookPayload) *result {
+	if _, err := s.deliverAt(payload); err != nil {
+		log.Printf("Rejecting payload: %v", err)
+		return &result{fiber.StatusBadRequest, fiber.Map{
+			"error": err.Error(),
+		}}
+	}
+	return nil
+}
+
+// hold keeps msg until its DeliverAt time, persisting it first.
+func (s *scheduler) hold(msg deferredMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(s.pending, msg)
+	if err := writeDeferred(s.storePath, s.pending); err != nil {
+		s.pending = s.pending[:len(s.pending)-1]
+		return err
+	}
+	return nil
+}
+
+// run hands due messages to send every minute until ctx is cancelled. Messages send
+// reports as failed transiently are kept and retried on the next tick.
+func (s *scheduler) run(ctx context.Context, send func(ctx context.Context, msg deferredMessage) (retry bool)) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		// Messages are only ever appended while we send, so the indexes stay valid
+		s.mu.Lock()
+		var due []int
+		for i, msg := range s.pending {
+			if !msg.DeliverAt.After(time.Now()) {
+				due = append(due, i)
+			}
+		}
+		msgs := make([]deferredMessage, len(due))
+		for i, index := range due {
+			msgs[i] = s.pending[index]
+		}
+		s.mu.Unlock()
+
+		if len(msgs) > 0 {
+			log.Printf("Delivering %d scheduled notifications", len(msgs))
+			done := make(map[int]bool)
+			for i, msg := range msgs {
+				if !send(ctx, msg) {
+					done[due[i]] = true
+				}
+			}
+
+			s.mu.Lock()
+			kept := s.pending[:0]
+			for i, msg := range s.pending {
+				if !done[i] {
+					kept = append(kept, msg)
+				}
+			}
+			s.pending = kept
+			if err := writeDeferred(s.storePath, s.pending); err != nil {
+				log.Printf("Error saving scheduled notifications: %v", err)
+			}
+			s.mu.Unlock()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
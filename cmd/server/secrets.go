@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// secretProvider resolves a secret reference, without its scheme, to its value.
+type secretProvider interface {
+	resolve(ctx context.Context, ref string) (string, error)
+}
+
+// fileSecrets reads secrets from files, e.g. file:///run/secrets/smtp_password.
+type fileSecrets struct{}
+
+func (fileSecrets) resolve(_ context.Context, ref string) (string, error) {
+	data, err := os.ReadFile(ref)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// vaultSecrets reads secrets from HashiCorp Vault over its HTTP API using VAULT_ADDR,
+// VAULT_TOKEN and optionally VAULT_NAMESPACE. References look like
+// vault://secret/data/smtp#password; both KV version 1 and 2 responses are understood.
+type vaultSecrets struct {
+	client *http.Client
+	cache  map[string]map[string]any // Secret data by path, so each path is read once
+}
+
+func (v *vaultSecrets) resolve(ctx context.Context, ref string) (string, error) {
+	path, key, ok := strings.Cut(ref, "#")
+	if !ok || path == "" || key == "" {
+		return "", fmt.Errorf("expected vault://PATH#KEY")
+	}
+
+	data, ok := v.cache[path]
+	if !ok {
+		var err error
+		if data, err = v.read(ctx, path); err != nil {
+			return "", err
+		}
+		v.cache[path] = data
+	}
+	value, ok := data[key].(string)
+	if !ok {
+		return "", fmt.Errorf("vault secret %s has no string key %q", path, key)
+	}
+	return value, nil
+}
+
+// read fetches the data of the secret at path.
+func (v *vaultSecrets) read(ctx context.Context, path string) (map[string]any, error) {
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return nil, fmt.Errorf("VAULT_ADDR must be set to resolve vault:// secrets")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(addr, "/")+"/v1/"+strings.TrimLeft(path, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault returned %s for %s", resp.Status, path)
+	}
+
+	var body struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decoding vault response for %s: %w", path, err)
+	}
+	// KV version 2 nests the secret one level deeper, next to its metadata
+	if nested, ok := body.Data["data"].(map[string]any); ok {
+		if _, hasMeta := body.Data["metadata"]; hasMeta {
+			return nested, nil
+		}
+	}
+	return body.Data, nil
+}
+
+// unsupportedSecrets rejects references to a known but unimplemented provider, so they
+// fail at startup instead of being used verbatim as credentials.
+type unsupportedSecrets string
+
+func (u unsupportedSecrets) resolve(context.Context, string) (string, error) {
+	return "", fmt.Errorf("the %s secret provider is not supported yet", string(u))
+}
+
+// resolveSecrets replaces the value of every known setting that is a secret reference
+// such as vault://secret/data/smtp#password or file:///run/secrets/smtp_password with the
+// secret it points to. Variables the service doesn't read are left alone, whatever they
+// hold. It runs once at startup, before any configuration is read.
+func resolveSecrets() error {
+	providers := map[string]secretProvider{
+		"file://":  fileSecrets{},
+		"vault://": &vaultSecrets{client: &http.Client{Timeout: 10 * time.Second}, cache: make(map[string]map[string]any)},
+		"awssm://": unsupportedSecrets("AWS Secrets Manager"),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	for _, setting := range knownSettings {
+		name := setting.name
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		for scheme, provider := range providers {
+			ref, ok := strings.CutPrefix(value, scheme)
+			if !ok {
+				continue
+			}
+			secret, err := provider.resolve(ctx, ref)
+			if err != nil {
+				return fmt.Errorf("resolving %s: %w", name, err)
+			}
+			os.Setenv(name, secret)
+			log.Printf("Resolved %s from %s", name, strings.TrimSuffix(scheme, "://"))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveSecretsOnlyKnownSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "smtp_password")
+	if err := os.WriteFile(path, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SMTP_PASSWORD", "file://"+path)
+	t.Setenv("VAULT_ADDR", "")
+	// Would fail to resolve without VAULT_ADDR, and belongs to some other program
+	t.Setenv("OTHER_TOOL_TOKEN", "vault://secret/data/other#token")
+
+	if err := resolveSecrets(); err != nil {
+		t.Fatalf("resolveSecrets: %v", err)
+	}
+	if got := os.Getenv("SMTP_PASSWORD"); got != "s3cret" {
+		t.Errorf("SMTP_PASSWORD = %q, want the file's contents", got)
+	}
+	if got := os.Getenv("OTHER_TOOL_TOKEN"); got != "vault://secret/data/other#token" {
+		t.Errorf("OTHER_TOOL_TOKEN = %q, want it left untouched", got)
+	}
+}
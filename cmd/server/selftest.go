@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+)
+
+// selfTester is implemented by senders that can check their relay without sending.
+type selfTester interface {
+	selfTest(ctx context.Context) error
+}
+
+// runSelfTest connects and authenticates to the relay before the server starts when
+// STARTUP_SELFTEST is true, so bad credentials fail the start instead of the first
+// alert. With SELFTEST_SOFT a failure is only logged.
+func runSelfTest(sender Sender) error {
+	if os.Getenv("STARTUP_SELFTEST") != "true" {
+		return nil
+	}
+	tester, ok := sender.(selfTester)
+	if !ok {
+		log.Println("Startup self-test only applies to the SMTP backend, skipping")
+		return nil
+	}
+
+	err := tester.selfTest(context.Background())
+	switch {
+	case err == nil:
+		log.Println("Startup self-test passed")
+		return nil
+	case os.Getenv("SELFTEST_SOFT") == "true":
+		log.Printf("Warning: startup self-test failed, starting anyway: %v", err)
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// Message is an email ready to be handed to a Sender.
+type Message struct {
+	ID      string // Message-ID header value; generated when empty
+	From    string
+	To      []string
+	Subject string
+	Body    string
+	Relay   string // Pins delivery to relayPrimary or relayFallback; empty allows both
+
+	HTMLBody    string // Sent as text/html, as an alternative to Body when both are set
+	Attachments []attachment
+
+	InReplyTo  string   // Message-ID this message follows up on
+	References []string // Message-IDs of the thread so far, oldest first
+
+	Bcc []string // Envelope-only recipients, left out of the headers
+}
+
+// envelopeRecipients returns every address the message is delivered to, each once.
+func (m Message) envelopeRecipients() []string {
+	if len(m.Bcc) == 0 {
+		return m.To
+	}
+	recipients := append([]string{}, m.To...)
+	for _, bcc := range m.Bcc {
+		duplicate := false
+		for _, to := range m.To {
+			if strings.EqualFold(to, bcc) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			recipients = append(recipients, bcc)
+		}
+	}
+	return recipients
+}
+
+// Sender delivers messages to their recipients.
+type Sender interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// smtpRelay holds the connection settings for a single SMTP server.
+type smtpRelay struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	Timeout  time.Duration       // Limits a single delivery attempt; zero means no limit
+	TLS      *tls.Config         // Base STARTTLS settings; nil uses the system defaults
+	DSN      bool                // Request delivery status notifications when the relay supports them
+	Proxy    proxy.ContextDialer // Dials through SMTP_PROXY_URL; nil dials directly
+	Domains  *domainLimiter      // Shared by both relays, so limits hold across them
+	Verify   bool                // Probe every recipient with RCPT TO before sending to any
+}
+
+// addr returns the host:port address of the relay.
+func (r smtpRelay) addr() string {
+	return net.JoinHostPort(r.Host, strconv.Itoa(r.Port))
+}
+
+// send delivers msg through the relay. Authentication is skipped when no username is
+// configured, which only the fallback relay allows.
+// Cancelling ctx aborts the SMTP conversation, however far it has progressed.
+func (r smtpRelay) send(ctx context.Context, from string, to []string, msg []byte) error {
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+
+	release, err := r.Domains.acquire(ctx, to)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	conn, err := r.dial(ctx)
+	if err != nil {
+		return err
+	}
+	// Force any blocked read or write to fail as soon as ctx is cancelled
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
+	err = r.converse(conn, from, to, msg)
+	if ctxErr := ctx.Err(); err != nil && ctxErr != nil {
+		return fmt.Errorf("%w: %v", ctxErr, err)
+	}
+	return err
+}
+
+// dial connects to the relay, through the proxy if one is configured, applying the
+// deadline of ctx to the connection.
+func (r smtpRelay) dial(ctx context.Context) (net.Conn, error) {
+	var dialer proxy.ContextDialer = &net.Dialer{}
+	if r.Proxy != nil {
+		dialer = r.Proxy
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", r.addr())
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return conn, nil
+}
+
+// check connects to the relay and authenticates without sending anything, proving the
+// relay is reachable and accepts the credentials.
+func (r smtpRelay) check(ctx context.Context) error {
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+	conn, err := r.dial(ctx)
+	if err != nil {
+		return err
+	}
+	c, err := smtp.NewClient(conn, r.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if err := r.hello(c); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// hello upgrades the session to TLS when the relay offers it and authenticates.
+func (r smtpRelay) hello(c *smtp.Client) error {
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		tlsConfig := &tls.Config{}
+		if r.TLS != nil {
+			tlsConfig = r.TLS.Clone()
+		}
+		tlsConfig.ServerName = r.Host
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if r.Username != "" {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("smtp: server doesn't support AUTH")
+		}
+		if err := c.Auth(smtp.PlainAuth("", r.Username, r.Password, r.Host)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// converse runs the SMTP conversation for one message over conn, mirroring smtp.SendMail.
+func (r smtpRelay) converse(conn net.Conn, from string, to []string, msg []byte) error {
+	c, err := smtp.NewClient(conn, r.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if err := r.hello(c); err != nil {
+		return err
+	}
+
+	if r.Verify {
+		if err := probeRecipients(c, from, to); err != nil {
+			return err
+		}
+	}
+
+	dsn := false
+	if r.DSN {
+		if dsn, _ = c.Extension("DSN"); !dsn {
+			log.Printf("Relay %s does not advertise DSN, sending without delivery status notifications", r.addr())
+		}
+	}
+	if ok, _ := c.Extension("PIPELINING"); ok {
+		if err := pipelineEnvelope(c, from, to, dsn); err != nil {
+			return err
+		}
+	} else {
+		if err := c.Mail(from); err != nil {
+			return err
+		}
+		for _, addr := range to {
+			if err := rcpt(c, addr, dsn); err != nil {
+				return err
+			}
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// recipientsRejectedError reports the recipients a relay refused during a RCPT probe.
+type recipientsRejectedError struct {
+	rejected []string
+	replies  []string
+}
+
+func (e *recipientsRejectedError) Error() string {
+	return fmt.Sprintf("relay rejected %d recipient(s): %s", len(e.rejected), strings.Join(e.replies, "; "))
+}
+
+// probeRecipients checks every recipient with MAIL FROM and RCPT TO, then resets the
+// transaction without sending DATA. Only permanent 5xx refusals count as rejections;
+// many relays accept every address at this stage, so a clean probe proves little.
+func probeRecipients(c *smtp.Client, from string, to []string) error {
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	rejected := &recipientsRejectedError{}
+	for _, addr := range to {
+		var smtpErr *textproto.Error
+		if err := c.Rcpt(addr); errors.As(err, &smtpErr) && smtpErr.Code/100 == 5 {
+			rejected.rejected = append(rejected.rejected, addr)
+			rejected.replies = append(rejected.replies, fmt.Sprintf("%s: %d %s", addr, smtpErr.Code, smtpErr.Msg))
+		} else if err != nil && smtpErr == nil {
+			return err
+		}
+	}
+	if err := c.Reset(); err != nil {
+		return err
+	}
+	if len(rejected.rejected) > 0 {
+		return rejected
+	}
+	return nil
+}
+
+// rcpt issues RCPT TO for addr. With dsn set it asks the relay to report both successful
+// and failed delivery (RFC 3461), which net/smtp has no option for.
+func rcpt(c *smtp.Client, addr string, dsn bool) error {
+	if !dsn {
+		return c.Rcpt(addr)
+	}
+	if strings.ContainsAny(addr, "\r\n") {
+		return errors.New("smtp: A line must not contain CR or LF")
+	}
+	id, err := c.Text.Cmd("%s", rcptCommand(addr, dsn))
+	if err != nil {
+		return err
+	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	_, _, err = c.Text.ReadResponse(25)
+	return err
+}
+
+// rcptCommand returns the RCPT TO command line for addr.
+func rcptCommand(addr string, dsn bool) string {
+	if dsn {
+		return "RCPT TO:<" + addr + "> NOTIFY=SUCCESS,FAILURE"
+	}
+	return "RCPT TO:<" + addr + ">"
+}
+
+// pipelineEnvelope writes MAIL FROM and every RCPT TO in one go, as PIPELINING (RFC 2920)
+// allows, then reads the replies in order. This saves a round trip per recipient on
+// large distribution lists. The first rejected command's error is returned.
+func pipelineEnvelope(c *smtp.Client, from string, to []string, dsn bool) error {
+	// Mirror the parameters smtp.Client.Mail would add
+	mail := "MAIL FROM:<" + from + ">"
+	if ok, _ := c.Extension("8BITMIME"); ok {
+		mail += " BODY=8BITMIME"
+	}
+	if ok, _ := c.Extension("SMTPUTF8"); ok {
+		mail += " SMTPUTF8"
+	}
+	cmds := []string{mail}
+	for _, addr := range to {
+		cmds = append(cmds, rcptCommand(addr, dsn))
+	}
+
+	ids := make([]uint, len(cmds))
+	for i, cmd := range cmds {
+		if strings.ContainsAny(cmd, "\r\n") {
+			return errors.New("smtp: A line must not contain CR or LF")
+		}
+		ids[i] = c.Text.Next()
+		c.Text.StartRequest(ids[i])
+		c.Text.W.WriteString(cmd + "\r\n")
+		c.Text.EndRequest(ids[i])
+	}
+	if err := c.Text.W.Flush(); err != nil {
+		return err
+	}
+
+	var firstErr error
+	for _, id := range ids {
+		c.Text.StartResponse(id)
+		_, _, err := c.Text.ReadResponse(25)
+		c.Text.EndResponse(id)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// SMTPSender sends messages through an SMTP relay, falling back to a secondary
+// relay once if all attempts against the primary one fail.
+type SMTPSender struct {
+	Primary      smtpRelay
+	Fallback     *smtpRelay
+	From         string
+	To           string
+	EnvelopeFrom string // MAIL FROM address or domain, when it differs from the header From
+	LogHeaders   bool   // Log the header block of every message for auditing
+	Retry        retryPolicy
+	Builder      *messageBuilder
+}
+
+// newSMTPSenderFromEnv builds an SMTPSender from the environment.
+func newSMTPSenderFromEnv() (*SMTPSender, error) {
+	sender := &SMTPSender{
+		Primary: smtpRelay{
+			Host:     os.Getenv("SMTP_HOST"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+		},
+	}
+
+	// Basic validation for environment variables
+	primary := sender.Primary
+	if primary.Host == "" || os.Getenv("SMTP_PORT") == "" || primary.Username == "" || primary.Password == "" {
+		return nil, fmt.Errorf("SMTP configuration missing in .env or environment variables. Please check SMTP_HOST, SMTP_PORT, SMTP_USERNAME, SMTP_PASSWORD")
+	}
+	port, err := parsePort("SMTP_PORT", os.Getenv("SMTP_PORT"))
+	if err != nil {
+		return nil, err
+	}
+	sender.Primary.Port = port
+
+	fallback := smtpRelay{
+		Host:     os.Getenv("SMTP_FALLBACK_HOST"),
+		Username: os.Getenv("SMTP_FALLBACK_USERNAME"),
+		Password: os.Getenv("SMTP_FALLBACK_PASSWORD"),
+	}
+	if fallbackPort := os.Getenv("SMTP_FALLBACK_PORT"); fallback.Host != "" && fallbackPort != "" {
+		fallback.Port, err = parsePort("SMTP_FALLBACK_PORT", fallbackPort)
+		if err != nil {
+			return nil, err
+		}
+		sender.Fallback = &fallback
+	}
+
+	sender.Primary.Timeout = 30 * time.Second
+	if v := os.Getenv("SMTP_TIMEOUT"); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SMTP_TIMEOUT %q: %w", v, err)
+		}
+		sender.Primary.Timeout = timeout
+	}
+
+	tlsConfig, err := loadTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	sender.Primary.TLS = tlsConfig
+
+	sender.Primary.DSN = os.Getenv("REQUEST_DSN") == "true"
+	if sender.Primary.Proxy, err = loadSMTPProxy(); err != nil {
+		return nil, err
+	}
+	if sender.Primary.Domains, err = loadDomainLimiter(); err != nil {
+		return nil, err
+	}
+	sender.Primary.Verify = os.Getenv("VERIFY_RECIPIENTS") == "true"
+	sender.EnvelopeFrom = os.Getenv("ENVELOPE_FROM")
+	sender.LogHeaders = os.Getenv("LOG_HEADERS") == "true"
+
+	if sender.Fallback != nil {
+		sender.Fallback.Timeout = sender.Primary.Timeout
+		sender.Fallback.TLS = sender.Primary.TLS
+		sender.Fallback.DSN = sender.Primary.DSN
+		sender.Fallback.Proxy = sender.Primary.Proxy
+		sender.Fallback.Domains = sender.Primary.Domains
+		sender.Fallback.Verify = sender.Primary.Verify
+	}
+
+	policy, err := loadRetryPolicy()
+	if err != nil {
+		return nil, err
+	}
+	sender.Retry = policy
+
+	builder, err := loadMessageBuilder()
+	if err != nil {
+		return nil, err
+	}
+	sender.Builder = builder
+	return sender, nil
+}
+
+// selfTest checks that every configured relay is reachable and accepts its credentials.
+func (s *SMTPSender) selfTest(ctx context.Context) error {
+	if err := s.Primary.check(ctx); err != nil {
+		return fmt.Errorf("primary relay %s: %w", s.Primary.addr(), err)
+	}
+	if s.Fallback != nil {
+		if err := s.Fallback.check(ctx); err != nil {
+			return fmt.Errorf("fallback relay %s: %w", s.Fallback.addr(), err)
+		}
+	}
+	return nil
+}
+
+// Send implements Sender.
+func (s *SMTPSender) Send(ctx context.Context, m Message) error {
+	msg, err := s.Builder.build(m)
+	if err != nil {
+		return err
+	}
+
+	// The envelope needs ASCII domains; the headers above keep the display form
+	envelopeFrom, err := asciiAddress(envelopeSender(s.EnvelopeFrom, m.From))
+	if err != nil {
+		return err
+	}
+	envelopeTo, err := asciiAddresses(m.envelopeRecipients())
+	if err != nil {
+		return err
+	}
+	if s.LogHeaders {
+		logHeaders(envelopeFrom, envelopeTo, msg)
+	}
+
+	// Routes may pin delivery to the fallback relay, which still only gets a single attempt
+	if m.Relay == relayFallback && s.Fallback != nil {
+		log.Printf("Attempting to send email from %s to %s via %s...", m.From, strings.Join(m.To, ", "), s.Fallback.addr())
+		if err := s.Fallback.send(ctx, envelopeFrom, envelopeTo, msg); err != nil {
+			return fmt.Errorf("failed to send email via fallback relay: %w", err)
+		}
+		log.Printf("Email sent successfully via fallback relay %s", s.Fallback.addr())
+		return nil
+	}
+
+	// Send the email through the primary relay, retrying transient failures
+	log.Printf("Attempting to send email from %s to %s via %s...", m.From, strings.Join(m.To, ", "), s.Primary.addr())
+	err = s.Retry.do(ctx, func(ctx context.Context) error {
+		return s.Primary.send(ctx, envelopeFrom, envelopeTo, msg)
+	})
+	if err == nil {
+		log.Printf("Email sent successfully via primary relay %s", s.Primary.addr())
+		return nil
+	}
+
+	// Recipients refused by the probe would be refused by the fallback relay just the same
+	var rejected *recipientsRejectedError
+	if s.Fallback == nil || m.Relay == relayPrimary || ctx.Err() != nil || errors.As(err, &rejected) {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+
+	// Give the fallback relay a single attempt before giving up
+	log.Printf("Primary relay %s failed: %v. Attempting fallback relay %s...", s.Primary.addr(), err, s.Fallback.addr())
+	if fallbackErr := s.Fallback.send(ctx, envelopeFrom, envelopeTo, msg); fallbackErr != nil {
+		attempts, _ := sendAttempts(err)
+		return fmt.Errorf("failed to send email via primary relay (%v) and fallback relay: %w", err, &attemptsError{attempts + 1, fallbackErr})
+	}
+
+	log.Printf("Email sent successfully via fallback relay %s", s.Fallback.addr())
+	return nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// smtpStub is an in-process SMTP server that accepts every message and records the
+// envelope and data of each.
+type smtpStub struct {
+	ln         net.Listener
+	pipelining bool          // Advertise PIPELINING
+	latency    time.Duration // Delay before each batch of replies, like a network round trip
+
+	mu       sync.Mutex
+	messages []stubMessage
+}
+
+// stubMessage is a message as received by smtpStub.
+type stubMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+// newSMTPStub starts a stub listening on a loopback port until the test ends.
+func newSMTPStub(tb testing.TB, pipelining bool) *smtpStub {
+	tb.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("listening: %v", err)
+	}
+	s := &smtpStub{ln: ln, pipelining: pipelining}
+	tb.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// relay returns the settings for sending through the stub.
+func (s *smtpStub) relay() smtpRelay {
+	addr := s.ln.Addr().(*net.TCPAddr)
+	return smtpRelay{Host: addr.IP.String(), Port: addr.Port}
+}
+
+// received returns the messages received so far.
+func (s *smtpStub) received() []stubMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]stubMessage{}, s.messages...)
+}
+
+// serve runs one SMTP session on conn.
+func (s *smtpStub) serve(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	w := bufio.NewWriter(conn)
+	reply := func(lines ...string) {
+		for _, line := range lines {
+			w.WriteString(line + "\r\n")
+		}
+		// Replies to pipelined commands may be sent in one go
+		if text.R.Buffered() == 0 {
+			time.Sleep(s.latency)
+			w.Flush()
+		}
+	}
+
+	reply("220 stub ESMTP")
+	var msg stubMessage
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(verb, "EHLO"):
+			if s.pipelining {
+				reply("250-stub", "250-PIPELINING", "250 8BITMIME")
+			} else {
+				reply("250-stub", "250 8BITMIME")
+			}
+		case strings.HasPrefix(verb, "MAIL FROM:"):
+			msg = stubMessage{from: envelopeAddress(line)}
+			reply("250 OK")
+		case strings.HasPrefix(verb, "RCPT TO:"):
+			msg.to = append(msg.to, envelopeAddress(line))
+			reply("250 OK")
+		case verb == "DATA":
+			reply("354 Go ahead")
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.data = string(data)
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			reply("250 OK")
+		case verb == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+// envelopeAddress returns the address between the angle brackets of a MAIL or RCPT command.
+func envelopeAddress(line string) string {
+	start, end := strings.Index(line, "<"), strings.Index(line, ">")
+	if start < 0 || end < start {
+		return ""
+	}
+	return line[start+1 : end]
+}
+
+func TestSendUnicodeDomainRecipient(t *testing.T) {
+	stub := newSMTPStub(t, false)
+	sender := &SMTPSender{
+		Primary: stub.relay(),
+		Retry:   retryPolicy{maxAttempts: 1},
+		Builder: &messageBuilder{charset: "UTF-8"},
+	}
+
+	msg := Message{From: "sender@example.com", To: []string{"user@müller.de"}, Subject: "Test", Body: "Hello"}
+	if err := sender.Send(context.Background(), msg); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	received := stub.received()
+	if len(received) != 1 {
+		t.Fatalf("received %d messages, want 1", len(received))
+	}
+	if got, want := strings.Join(received[0].to, ","), "user@xn--mller-kva.de"; got != want {
+		t.Errorf("envelope recipients = %q, want %q", got, want)
+	}
+	if !strings.Contains(received[0].data, "To: user@müller.de\n") {
+		t.Errorf("To header lost its display form:\n%s", received[0].data)
+	}
+}
+
+func TestSMTPPortValidation(t *testing.T) {
+	tests := []struct {
+		port    string
+		want    int
+		wantErr string
+	}{
+		{port: "587", want: 587},
+		{port: "1", want: 1},
+		{port: "65535", want: 65535},
+		{port: "abc", wantErr: "must be a number"},
+		{port: "0", wantErr: "must be between 1 and 65535"},
+		{port: "65536", wantErr: "must be between 1 and 65535"},
+		{port: "-1", wantErr: "must be between 1 and 65535"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.port, func(t *testing.T) {
+			t.Setenv("SMTP_HOST", "smtp.example.com")
+			t.Setenv("SMTP_PORT", tt.port)
+			t.Setenv("SMTP_USERNAME", "user")
+			t.Setenv("SMTP_PASSWORD", "secret")
+
+			sender, err := newSMTPSenderFromEnv()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), "SMTP_PORT") || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want an SMTP_PORT error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newSMTPSenderFromEnv: %v", err)
+			}
+			if sender.Primary.Port != tt.want {
+				t.Errorf("port = %d, want %d", sender.Primary.Port, tt.want)
+			}
+		})
+	}
+}
+
+func BenchmarkSend50Recipients(b *testing.B) {
+	to := make([]string, 50)
+	for i := range to {
+		to[i] = fmt.Sprintf("user%d@example.com", i)
+	}
+	msg := Message{From: "sender@example.com", To: to, Subject: "Test", Body: "Hello"}
+
+	for _, pipelining := range []bool{false, true} {
+		b.Run(fmt.Sprintf("pipelining=%t", pipelining), func(b *testing.B) {
+			stub := newSMTPStub(b, pipelining)
+			stub.latency = time.Millisecond
+			sender := &SMTPSender{
+				Primary: stub.relay(),
+				Retry:   retryPolicy{maxAttempts: 1},
+				Builder: &messageBuilder{charset: "UTF-8"},
+			}
+			log.SetOutput(io.Discard)
+			b.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+			b.ResetTimer()
+			for range b.N {
+				if err := sender.Send(context.Background(), msg); err != nil {
+					b.Fatalf("Send: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestSendCancelledMidConversation(t *testing.T) {
+	stub := newSMTPStub(t, false)
+	stub.latency = 10 * time.Second // The greeting never comes in time
+	relay := stub.relay()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := relay.send(ctx, "sender@example.com", []string{"admin@example.com"}, []byte("Subject: Test\r\n\r\nHello\r\n"))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("send took %s after the context was cancelled", elapsed)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want it to wrap context.DeadlineExceeded", err)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Relay names a sender route may pin delivery to.
+const (
+	relayPrimary  = "primary"
+	relayFallback = "fallback"
+)
+
+// identity is the sender an email goes out as, and optionally the relay it goes through.
+type identity struct {
+	From  string
+	Relay string // Empty means the primary relay with fallback
+}
+
+// senderRoute picks an identity for payloads whose field matches pattern.
+type senderRoute struct {
+	field   string // "status" or "source"
+	pattern *regexp.Regexp
+	id      identity
+}
+
+// loadSenderRoutes parses SENDER_ROUTES, a semicolon-separated list of rules such as
+// "status:Fail*=monitoring@example.com; source:\\backup01\*=backups@example.com|fallback".
+// Patterns are case-insensitive and only "*" is special, so Windows paths need no escaping.
+// An optional "|primary" or "|fallback" suffix pins the relay used for matching emails.
+func loadSenderRoutes() ([]senderRoute, error) {
+	var routes []senderRoute
+	for _, rule := range strings.Split(os.Getenv("SENDER_ROUTES"), ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		match, target, ok := strings.Cut(rule, "=")
+		field, pattern, hasField := strings.Cut(match, ":")
+		field = strings.ToLower(strings.TrimSpace(field))
+		if !ok || !hasField || (field != "status" && field != "source") {
+			return nil, fmt.Errorf("invalid SENDER_ROUTES rule %q: expected status:PATTERN=ADDRESS or source:PATTERN=ADDRESS", rule)
+		}
+
+		from, relay, _ := strings.Cut(strings.TrimSpace(target), "|")
+		from, relay = strings.TrimSpace(from), strings.ToLower(strings.TrimSpace(relay))
+		if err := validateFrom(from); err != nil {
+			return nil, fmt.Errorf("invalid SENDER_ROUTES rule %q: %w", rule, err)
+		}
+		if relay != "" && relay != relayPrimary && relay != relayFallback {
+			return nil, fmt.Errorf("invalid SENDER_ROUTES rule %q: relay must be %s or %s", rule, relayPrimary, relayFallback)
+		}
+
+		routes = append(routes, senderRoute{
+			field:   field,
+			pattern: globPattern(strings.TrimSpace(pattern)),
+			id:      identity{From: from, Relay: relay},
+		})
+	}
+	return routes, nil
+}
+
+// globPattern compiles a case-insensitive pattern where "*" matches any run of characters.
+func globPattern(glob string) *regexp.Regexp {
+	quoted := strings.ReplaceAll(regexp.QuoteMeta(glob), `\*`, ".*")
+	return regexp.MustCompile("(?is)^" + quoted + "$")
+}
+
+// validateFrom checks that addr is a bare email address usable as a sender.
+func validateFrom(addr string) error {
+	parsed, err := mail.ParseAddress(addr)
+	if err != nil || parsed.Address != addr {
+		return fmt.Errorf("invalid sender address %q", addr)
+	}
+	return nil
+}
+
+// identityFor returns the identity of the first sender route matching p, or the default
+// SENDER_EMAIL identity when none does.
+func (m mailConfig) identityFor(p *WebhookPayload) identity {
+	for _, route := range m.SenderRoutes {
+		value := p.Status
+		if route.field == "source" {
+			value = p.Source
+		}
+		if route.pattern.MatchString(value) {
+			return route.id
+		}
+	}
+	return identity{From: m.From}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// SendmailSender delivers messages by piping them to a local sendmail binary, for hosts
+// that prefer handing mail to their own MTA.
+type SendmailSender struct {
+	Path         string // Path to the sendmail binary
+	EnvelopeFrom string // MAIL FROM address or domain, when it differs from the header From
+	LogHeaders   bool
+	Builder      *messageBuilder
+}
+
+// newSendmailSenderFromEnv builds a SendmailSender from the environment. SENDMAIL_PATH
+// defaults to /usr/sbin/sendmail.
+func newSendmailSenderFromEnv() (*SendmailSender, error) {
+	sender := &SendmailSender{
+		Path:         "/usr/sbin/sendmail",
+		EnvelopeFrom: os.Getenv("ENVELOPE_FROM"),
+		LogHeaders:   os.Getenv("LOG_HEADERS") == "true",
+	}
+	if v := os.Getenv("SENDMAIL_PATH"); v != "" {
+		sender.Path = v
+	}
+	if _, err := exec.LookPath(sender.Path); err != nil {
+		return nil, fmt.Errorf("invalid SENDMAIL_PATH %q: %w", sender.Path, err)
+	}
+
+	builder, err := loadMessageBuilder()
+	if err != nil {
+		return nil, err
+	}
+	sender.Builder = builder
+	return sender, nil
+}
+
+// Send implements Sender. Recipients are passed as arguments rather than read from the
+// headers with -t, so the envelope is exactly what the notifier decided on.
+func (s *SendmailSender) Send(ctx context.Context, m Message) error {
+	msg, err := s.Builder.build(m)
+	if err != nil {
+		return err
+	}
+	envelopeFrom, err := asciiAddress(envelopeSender(s.EnvelopeFrom, m.From))
+	if err != nil {
+		return err
+	}
+	envelopeTo, err := asciiAddresses(m.envelopeRecipients())
+	if err != nil {
+		return err
+	}
+	if s.LogHeaders {
+		logHeaders(envelopeFrom, envelopeTo, msg)
+	}
+
+	// -i keeps a line holding a single dot from ending the message early
+	args := append([]string{"-i", "-f", envelopeFrom, "--"}, envelopeTo...)
+	cmd := exec.CommandContext(ctx, s.Path, args...)
+	// Local submission uses the platform's line endings; the MTA restores CRLF on the wire
+	cmd.Stdin = bytes.NewReader(bytes.ReplaceAll(msg, []byte("\r\n"), []byte("\n")))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	log.Printf("Attempting to send email from %s to %s via %s...", m.From, strings.Join(m.To, ", "), s.Path)
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return fmt.Errorf("failed to send email: %s exited with code %d: %s", s.Path, exitErr.ExitCode(), strings.TrimSpace(stderr.String()))
+		}
+		return fmt.Errorf("failed to send email: running %s: %w", s.Path, err)
+	}
+	log.Printf("Email sent successfully via %s", s.Path)
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// serverConfig holds the HTTP server tuning knobs. MaxConnsPerIP is not part of
+// fiber.Config and is applied to the underlying fasthttp server instead.
+type serverConfig struct {
+	fiber.Config
+	MaxConnsPerIP int
+}
+
+// loadServerConfig reads the SERVER_* settings. Timeouts default to values that keep
+// slow or idle clients from holding connections open indefinitely; 0 disables one.
+func loadServerConfig() (serverConfig, error) {
+	cfg := serverConfig{Config: fiber.Config{
+		Concurrency:  fiber.DefaultConcurrency,
+		BodyLimit:    fiber.DefaultBodyLimit,
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 30 * time.Second,
+		IdleTimeout:  2 * time.Minute,
+
+		// Let uploads be streamed, and refused as soon as they run over a limit, rather
+		// than received in full first; limitRequestBody enforces BodyLimit
+		StreamRequestBody:            true,
+		DisablePreParseMultipartForm: true,
+	}}
+
+	var err error
+	if cfg.Concurrency, err = serverInt("SERVER_CONCURRENCY", cfg.Concurrency, 1); err != nil {
+		return serverConfig{}, err
+	}
+	if cfg.BodyLimit, err = serverInt("SERVER_BODY_LIMIT", cfg.BodyLimit, 1); err != nil {
+		return serverConfig{}, err
+	}
+	if cfg.MaxConnsPerIP, err = serverInt("SERVER_MAX_CONNS_PER_IP", 0, 0); err != nil {
+		return serverConfig{}, err
+	}
+	if v := os.Getenv("SERVER_DISABLE_KEEPALIVE"); v != "" {
+		if cfg.DisableKeepalive, err = strconv.ParseBool(v); err != nil {
+			return serverConfig{}, fmt.Errorf("invalid SERVER_DISABLE_KEEPALIVE %q: must be true or false", v)
+		}
+	}
+	for _, t := range []struct {
+		name string
+		dst  *time.Duration
+	}{
+		{"SERVER_READ_TIMEOUT", &cfg.ReadTimeout},
+		{"SERVER_WRITE_TIMEOUT", &cfg.WriteTimeout},
+		{"SERVER_IDLE_TIMEOUT", &cfg.IdleTimeout},
+	} {
+		v := os.Getenv(t.name)
+		if v == "" {
+			continue
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return serverConfig{}, fmt.Errorf("invalid %s %q: must be a non-negative duration", t.name, v)
+		}
+		*t.dst = d
+	}
+	return cfg, nil
+}
+
+// serverInt parses the integer setting name, returning def when it is unset.
+func serverInt(name string, def, min int) (int, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	parsed, err := strconv.Atoi(v)
+	if err != nil || parsed < min {
+		return 0, fmt.Errorf("invalid %s %q: must be an integer of at least %d", name, v, min)
+	}
+	return parsed, nil
+}
+
+// apply sets the options fiber.Config does not cover on app's fasthttp server.
+func (c serverConfig) apply(app *fiber.App) {
+	app.Server().MaxConnsPerIP = c.MaxConnsPerIP
+}
+
+// logEffective logs the server settings in use, so defaults are visible at startup.
+func (c serverConfig) logEffective() {
+	log.Printf("Server settings: concurrency=%d max_conns_per_ip=%d body_limit=%d disable_keepalive=%t read_timeout=%s write_timeout=%s idle_timeout=%s",
+		c.Concurrency, c.MaxConnsPerIP, c.BodyLimit, c.DisableKeepalive, c.ReadTimeout, c.WriteTimeout, c.IdleTimeout)
+}
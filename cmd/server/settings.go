@@ -0,0 +1,164 @@
+package main
+
+import (
+	"os"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// setting describes one configuration variable for the /config endpoint.
+type setting struct {
+	name   string
+	def    string // Effective value when the variable is unset
+	secret bool   // Never reported, only whether it is set
+}
+
+// knownSettings lists every configuration variable the service reads, with the default
+// it falls back to. New settings must be added here to show up in GET /config.
+var knownSettings = []setting{
+	{name: "PORT", def: "3000"},
+	{name: "SMTP_HOST"},
+	{name: "SMTP_PORT"},
+	{name: "SMTP_USERNAME"},
+	{name: "SMTP_PASSWORD", secret: true},
+	{name: "SMTP_TIMEOUT", def: "30s"},
+	{name: "SMTP_FALLBACK_HOST"},
+	{name: "SMTP_FALLBACK_PORT"},
+	{name: "SMTP_FALLBACK_USERNAME"},
+	{name: "SMTP_FALLBACK_PASSWORD", secret: true},
+	{name: "SMTP_CA_FILE"},
+	{name: "SMTP_CLIENT_CERT_FILE"},
+	{name: "SMTP_CLIENT_KEY_FILE"},
+	{name: "SMTP_PROXY_URL", secret: true},
+	{name: "DOMAIN_CONCURRENCY", def: "0"},
+	{name: "DOMAIN_CONCURRENCY_OVERRIDES"},
+	{name: "REQUEST_DSN", def: "false"},
+	{name: "VERIFY_RECIPIENTS", def: "false"},
+	{name: "SENDER_EMAIL"},
+	{name: "SENDER_ROUTES"},
+	{name: "ENVELOPE_FROM"},
+	{name: "LOG_HEADERS", def: "false"},
+	{name: "RECIPIENT_EMAIL"},
+	{name: "RECIPIENTS_SUCCESS"},
+	{name: "RECIPIENTS_WARNING"},
+	{name: "RECIPIENTS_FAILURE"},
+	{name: "RECIPIENTS_FATAL"},
+	{name: "ALLOWED_RECIPIENT_DOMAINS"},
+	{name: "SUPPRESSION_FILE"},
+	{name: "MANAGE_SECRET", secret: true},
+	{name: "MANAGE_BASE_URL"},
+	{name: "MAX_ATTACHMENT_SIZE", def: "1048576"},
+	{name: "PAGERDUTY_ROUTING_KEY", secret: true},
+	{name: "PAGERDUTY_RESOLVE", def: "false"},
+	{name: "PAGERDUTY_URL", def: "https://events.pagerduty.com/v2/enqueue"},
+	{name: "HTML_BANNER", def: "false"},
+	{name: "HTML_COLOR_SUCCESS", def: "#2e7d32"},
+	{name: "HTML_COLOR_WARNING", def: "#ef6c00"},
+	{name: "HTML_COLOR_FAILURE", def: "#c62828"},
+	{name: "HTML_COLOR_FATAL", def: "#7f0000"},
+	{name: "RETRY_MAX_ATTEMPTS", def: "3"},
+	{name: "RETRY_BASE_DELAY", def: "1s"},
+	{name: "RETRY_MAX_DELAY", def: "30s"},
+	{name: "RETRY_TOTAL_TIMEOUT", def: "2m"},
+	{name: "RETRY_ON", def: defaultRetryOn},
+	{name: "GREYLIST_RETRY_DELAY", def: "1m"},
+	{name: "BODY_CHARSET", def: "UTF-8"},
+	{name: "SMIME_ENABLED", def: "false"},
+	{name: "SMIME_CERT_FILE"},
+	{name: "SMIME_KEY_FILE"},
+	{name: "BODY_FOOTER"},
+	{name: "MAX_BODY_LEN", def: "0"},
+	{name: "MAX_BODY_ATTACH", def: "false"},
+	{name: "MAX_RECIPIENTS", def: "0"},
+	{name: "SUBJECT_TEMPLATE"},
+	{name: "DEFAULT_SUBJECT", def: "Robocopy Notification"},
+	{name: "TRANSFORM_RULES_FILE"},
+	{name: "ROBOCOPY_SUMMARY", def: "false"},
+	{name: "COLLAPSE_BLANK_LINES", def: "false"},
+	{name: "INCLUDE_HOSTNAME", def: "false"},
+	{name: "BATCH_MAX_ITEMS", def: "100"},
+	{name: "REQUIRE_BODY", def: "false"},
+	{name: "ALWAYS_ACCEPT", def: "false"},
+	{name: "QUEUE_WORKERS", def: "4"},
+	{name: "QUEUE_AGING", def: "1m"},
+	{name: "DEAD_LETTER_FILE", def: "dead-letter.jsonl"},
+	{name: "JOB_SUMMARY_TIMEOUT"},
+	{name: "PRESEND_HOOK_URL"},
+	{name: "PRESEND_HOOK_TIMEOUT", def: "5s"},
+	{name: "PRESEND_HOOK_FAIL_OPEN", def: "false"},
+	{name: "QUIET_HOURS"},
+	{name: "QUIET_HOURS_TZ"},
+	{name: "QUIET_HOURS_STORE", def: "deferred.json"},
+	{name: "SCHEDULE_MAX_DELAY", def: "72h"},
+	{name: "SCHEDULE_STORE", def: "scheduled.json"},
+	{name: "HEARTBEAT_INTERVAL"},
+	{name: "HEARTBEAT_EMAIL"},
+	{name: "DISABLED_MIDDLEWARE"},
+	{name: "ERROR_RESPONSE_DELAY"},
+	{name: "MAX_INFLIGHT", def: "0"},
+	{name: "IDEMPOTENCY_TTL", def: "24h"},
+	{name: "MAX_REQUEST_TIMEOUT", def: "2m"},
+	{name: "ERROR_LOG_SIZE", def: "50"},
+	{name: "ATTACH_STRUCTURED", def: "false"},
+	{name: "MAIL_BACKEND", def: "smtp"},
+	{name: "SENDMAIL_PATH", def: "/usr/sbin/sendmail"},
+	{name: "STARTUP_SELFTEST", def: "false"},
+	{name: "SELFTEST_SOFT", def: "false"},
+	{name: "AUTO_SUBMITTED", def: "auto-generated"},
+	{name: "X_MAILER", def: "emailSender/<version>"},
+	{name: "THREAD_TTL", def: "24h"},
+	{name: "SUPPRESS_SUCCESS", def: "false"},
+	{name: "SUCCESS_MAX_EXIT_CODE", def: "3"},
+	{name: "EVENTS_BACKEND"},
+	{name: "EVENTS_URL", secret: true},
+	{name: "EVENTS_SUBJECT", def: "emailsender.notifications"},
+	{name: "MAX_TIMESTAMP_AGE"},
+	{name: "TIMESTAMP_SKEW", def: "1m"},
+	{name: "BCC_SENDER", def: "false"},
+	{name: "SERVER_CONCURRENCY", def: "262144"},
+	{name: "SERVER_MAX_CONNS_PER_IP", def: "0"},
+	{name: "SERVER_BODY_LIMIT", def: "4194304"},
+	{name: "SERVER_DISABLE_KEEPALIVE", def: "false"},
+	{name: "SERVER_READ_TIMEOUT", def: "30s"},
+	{name: "SERVER_WRITE_TIMEOUT", def: "30s"},
+	{name: "SERVER_IDLE_TIMEOUT", def: "2m"},
+	{name: "RESPONSE_COMPRESSION", def: "false"},
+	{name: "WEBHOOK_SECRET", secret: true},
+	{name: "SIGNATURE_HEADER", def: "X-Signature"},
+	{name: "SIGNATURE_PREFIX"},
+	{name: "ADMIN_API_KEY", secret: true},
+	{name: "OTEL_EXPORTER_OTLP_ENDPOINT"},
+	{name: "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"},
+	{name: "OTEL_SERVICE_NAME", def: "emailSender"},
+	{name: "VAULT_ADDR"},
+	{name: "VAULT_TOKEN", secret: true},
+	{name: "VAULT_NAMESPACE"},
+}
+
+// configHandler reports the effective value of every known setting and whether it came
+// from the environment (including .env), the -config file or a default. Secrets are redacted.
+func configHandler(c *fiber.Ctx) error {
+	settings := make(fiber.Map, len(knownSettings))
+	for _, s := range knownSettings {
+		value, fromEnv := os.LookupEnv(s.name)
+		if !fromEnv || value == "" {
+			value, fromEnv = s.def, false
+		}
+		if s.secret && value != "" {
+			value = "[redacted]"
+		}
+
+		_, fromFile := fileSettings[s.name]
+		source := "default"
+		switch {
+		case fromEnv && fromFile:
+			source = "file"
+		case fromEnv:
+			source = "environment"
+		}
+		settings[s.name] = fiber.Map{"value": value, "source": source}
+	}
+	return respond(c, fiber.StatusOK, fiber.Map{
+		"settings": settings,
+	})
+}
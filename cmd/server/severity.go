@@ -0,0 +1,61 @@
+package main
+
+import "strings"
+
+// severity is how urgent a notification is, decoded from the robocopy exit code and status.
+type severity int
+
+const (
+	severitySuccess severity = iota // Exit codes 0-3: nothing failed
+	severityWarning                 // Exit codes 4-7: mismatched files or directories
+	severityFailure                 // Exit codes 8-15: some files failed to copy
+	severityFatal                   // Exit code 16 and up: robocopy did not copy anything
+)
+
+// severities lists every severity, from least to most urgent.
+var severities = []severity{severitySuccess, severityWarning, severityFailure, severityFatal}
+
+// String returns the lowercase name used in config and logs.
+func (s severity) String() string {
+	switch s {
+	case severitySuccess:
+		return "success"
+	case severityWarning:
+		return "warning"
+	case severityFailure:
+		return "failure"
+	default:
+		return "fatal"
+	}
+}
+
+// payloadSeverity decodes the severity of a payload. Robocopy exit codes are bit flags,
+// so the highest bit set decides; a status naming a worse outcome takes precedence.
+func payloadSeverity(p *WebhookPayload) severity {
+	var sev severity
+	switch {
+	case p.ExitCode >= 16:
+		sev = severityFatal
+	case p.ExitCode&8 != 0:
+		sev = severityFailure
+	case p.ExitCode&4 != 0:
+		sev = severityWarning
+	default:
+		sev = severitySuccess
+	}
+
+	return max(sev, statusSeverity(p.Status))
+}
+
+// statusSeverity decodes the severity named by a payload status, if any.
+func statusSeverity(status string) severity {
+	switch strings.ToLower(strings.TrimSpace(status)) {
+	case "fatal":
+		return severityFatal
+	case "failure", "failed", "error":
+		return severityFailure
+	case "warning":
+		return severityWarning
+	}
+	return severitySuccess
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/smallstep/pkcs7"
+)
+
+// smimeSigner signs messages with S/MIME (RFC 8551) as multipart/signed with a detached
+// PKCS#7 signature, so clients without S/MIME support still show the text.
+type smimeSigner struct {
+	cert  *x509.Certificate
+	chain []*x509.Certificate // Intermediates included so recipients can verify the signer
+	key   crypto.PrivateKey
+}
+
+// loadSMIMESigner reads SMIME_ENABLED, SMIME_CERT_FILE and SMIME_KEY_FILE. It returns nil
+// when signing is disabled. The certificate file may hold the intermediates after the
+// signing certificate.
+func loadSMIMESigner() (*smimeSigner, error) {
+	if os.Getenv("SMIME_ENABLED") != "true" {
+		return nil, nil
+	}
+	certFile, keyFile := os.Getenv("SMIME_CERT_FILE"), os.Getenv("SMIME_KEY_FILE")
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("SMIME_CERT_FILE and SMIME_KEY_FILE must be set when SMIME_ENABLED is true")
+	}
+
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading S/MIME certificate: %w", err)
+	}
+	signer := &smimeSigner{key: pair.PrivateKey}
+	for i, der := range pair.Certificate {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("parsing S/MIME certificate: %w", err)
+		}
+		if i == 0 {
+			signer.cert = cert
+		} else {
+			signer.chain = append(signer.chain, cert)
+		}
+	}
+	if now := time.Now(); now.Before(signer.cert.NotBefore) || now.After(signer.cert.NotAfter) {
+		return nil, fmt.Errorf("S/MIME certificate %s is only valid from %s to %s",
+			signer.cert.Subject, signer.cert.NotBefore.Format(time.DateOnly), signer.cert.NotAfter.Format(time.DateOnly))
+	}
+	return signer, nil
+}
+
+// writeSigned writes the Content-Type header and multipart/signed body wrapping part, a
+// complete MIME entity with its own headers, to w.
+func (s *smimeSigner) writeSigned(w io.Writer, part []byte) error {
+	// Signatures cover the canonical CRLF form, which is also what goes over the wire
+	part = bytes.ReplaceAll(bytes.ReplaceAll(part, []byte("\r\n"), []byte("\n")), []byte("\n"), []byte("\r\n"))
+
+	signed, err := pkcs7.NewSignedData(part)
+	if err != nil {
+		return err
+	}
+	signed.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	if err := signed.AddSignerChain(s.cert, s.key, s.chain, pkcs7.SignerInfoConfig{}); err != nil {
+		return err
+	}
+	signed.Detach()
+	signature, err := signed.Finish()
+	if err != nil {
+		return err
+	}
+
+	var random [16]byte
+	rand.Read(random[:])
+	boundary := "smime-" + hex.EncodeToString(random[:])
+
+	var b strings.Builder
+	b.WriteString("Content-Type: multipart/signed; protocol=\"application/pkcs7-signature\"; micalg=sha-256;\r\n" +
+		" boundary=\"" + boundary + "\"\r\n" +
+		"\r\n" +
+		"This is a digitally signed message.\r\n" +
+		"--" + boundary + "\r\n")
+	b.Write(part)
+	// The CRLF before a boundary belongs to the boundary, not to the signed content
+	b.WriteString("\r\n--" + boundary + "\r\n" +
+		"Content-Type: application/pkcs7-signature; name=\"smime.p7s\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"Content-Disposition: attachment; filename=\"smime.p7s\"\r\n" +
+		"\r\n")
+	encoded := base64.StdEncoding.EncodeToString(signature)
+	for len(encoded) > maxPlainLineLength {
+		b.WriteString(encoded[:maxPlainLineLength] + "\r\n")
+		encoded = encoded[maxPlainLineLength:]
+	}
+	b.WriteString(encoded + "\r\n" +
+		"--" + boundary + "--\r\n")
+	_, err = io.WriteString(w, b.String())
+	return err
+}
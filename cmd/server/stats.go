@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// serviceStats holds process-wide counters. All fields are updated atomically so they
+// are safe to touch from any goroutine.
+type serviceStats struct {
+	started        time.Time
+	received       atomic.Int64
+	sent           atomic.Int64
+	failed         atomic.Int64
+	sendDurationNs atomic.Int64
+	inFlight       atomic.Int64
+
+	queue *notificationQueue // Reported per severity when ALWAYS_ACCEPT queues sends
+
+	mu        sync.Mutex
+	exitCodes map[exitCodeLabels]int64 // Received webhooks per severity and exit code bucket
+}
+
+// exitCodeLabels are the labels of the received webhooks metric.
+type exitCodeLabels struct {
+	severity severity
+	bucket   string
+}
+
+// stats is the process-wide counter set reported by GET /stats.
+var stats = &serviceStats{started: time.Now()}
+
+// recordReceived counts a received webhook, by severity and exit code bucket.
+func (s *serviceStats) recordReceived(payload *WebhookPayload) {
+	s.received.Add(1)
+	labels := exitCodeLabels{payloadSeverity(payload), exitCodeBucket(payload.ExitCode)}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.exitCodes == nil {
+		s.exitCodes = make(map[exitCodeLabels]int64)
+	}
+	s.exitCodes[labels]++
+}
+
+// exitCodeBucket names the most significant robocopy flag set in code, keeping metric
+// label cardinality bounded whatever codes callers send.
+func exitCodeBucket(code int) string {
+	switch {
+	case code == 0:
+		return "none"
+	case code < 0 || code >= 32:
+		return "other"
+	}
+	bucket := ""
+	for _, flag := range exitCodeFlags {
+		if code&flag.bit != 0 {
+			bucket = flag.name
+		}
+	}
+	return bucket
+}
+
+// recordSend records the outcome and duration of one send attempt.
+func (s *serviceStats) recordSend(duration time.Duration, err error) {
+	if err != nil {
+		s.failed.Add(1)
+	} else {
+		s.sent.Add(1)
+	}
+	s.sendDurationNs.Add(int64(duration))
+}
+
+// handler serves the current counters as JSON.
+func (s *serviceStats) handler(c *fiber.Ctx) error {
+	sent := s.sent.Load()
+	failed := s.failed.Load()
+
+	var avgMs float64
+	if attempts := sent + failed; attempts > 0 {
+		avgMs = float64(s.sendDurationNs.Load()) / float64(attempts) / float64(time.Millisecond)
+	}
+
+	body := fiber.Map{
+		"received":          s.received.Load(),
+		"sent":              sent,
+		"failed":            failed,
+		"avgSendDurationMs": avgMs,
+		"inFlight":          s.inFlight.Load(),
+		"uptimeSeconds":     int64(time.Since(s.started).Seconds()),
+	}
+	if s.queue != nil {
+		body["queueDepth"] = s.queue.depths()
+	}
+	return respond(c, fiber.StatusOK, body)
+}
+
+// metricsHandler serves the received webhooks counter in the Prometheus text format.
+func (s *serviceStats) metricsHandler(c *fiber.Ctx) error {
+	s.mu.Lock()
+	lines := make([]string, 0, len(s.exitCodes))
+	for labels, count := range s.exitCodes {
+		lines = append(lines, fmt.Sprintf("emailsender_webhooks_received_total{severity=%q,exit_code=%q} %d\n", labels.severity, labels.bucket, count))
+	}
+	s.mu.Unlock()
+	sort.Strings(lines)
+
+	var b strings.Builder
+	b.WriteString("# HELP emailsender_webhooks_received_total Webhooks received, by decoded severity and most significant robocopy exit code flag.\n" +
+		"# TYPE emailsender_webhooks_received_total counter\n")
+	for _, line := range lines {
+		b.WriteString(line)
+	}
+	c.Set(fiber.HeaderContentType, "text/plain; version=0.0.4; charset=utf-8")
+	return c.SendString(b.String())
+}
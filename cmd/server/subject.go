@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// defaultSubject is used when neither a template nor the email content provides a
+// subject and DEFAULT_SUBJECT is unset.
+const defaultSubject = "Robocopy Notification"
+
+// fallbackSubject returns DEFAULT_SUBJECT, or defaultSubject when it is unset.
+func fallbackSubject() string {
+	if subject := strings.Join(strings.Fields(os.Getenv("DEFAULT_SUBJECT")), " "); subject != "" {
+		return subject
+	}
+	return defaultSubject
+}
+
+// subjectData is what SUBJECT_TEMPLATE is executed against: every payload field, e.g.
+// {{ .Status }} or {{ .ExitCode }}, plus the decoded {{ .Severity }}.
+type subjectData struct {
+	*WebhookPayload
+	Severity string
+}
+
+// loadSubjectTemplate parses SUBJECT_TEMPLATE, returning nil when it's unset.
+func loadSubjectTemplate() (*template.Template, error) {
+	text := os.Getenv("SUBJECT_TEMPLATE")
+	if text == "" {
+		return nil, nil
+	}
+	tmpl, err := template.New("subject").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SUBJECT_TEMPLATE: %w", err)
+	}
+	return tmpl, nil
+}
+
+// renderSubject executes tmpl for payload, flattening the result onto one header line.
+func renderSubject(tmpl *template.Template, payload *WebhookPayload) (string, error) {
+	var b strings.Builder
+	data := subjectData{WebhookPayload: payload, Severity: payloadSeverity(payload).String()}
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return strings.Join(strings.Fields(b.String()), " "), nil
+}
+
+// extractSubject returns the subject embedded in the email content, or the fallback
+// subject when there is none or it is blank.
+func extractSubject(content string) string {
+	// Extract subject from the email content (first line after "Subject: ")
+	// The PowerShell script formats the subject as "Subject: Robocopy Failure Notification"
+	// We'll look for this line to extract the actual subject for the email.
+	emailLines := strings.Split(content, "\n")
+	for _, line := range emailLines {
+		if strings.HasPrefix(line, "Subject:") {
+			if subject := strings.TrimSpace(strings.TrimPrefix(line, "Subject:")); subject != "" {
+				return subject
+			}
+			log.Println("Subject line in email content is empty, using the default subject")
+			break
+		}
+	}
+	return fallbackSubject()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderSubject(t *testing.T) {
+	payload := &WebhookPayload{
+		Status:      "Failed",
+		Source:      `C:\Data`,
+		Destination: `\\backup\share`,
+		ExitCode:    8,
+		Host:        "fileserver01",
+		JobID:       "nightly-42",
+	}
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{"status", "Robocopy {{ .Status }}", "Robocopy Failed"},
+		{"exit code", "Exit code {{ .ExitCode }}", "Exit code 8"},
+		{"source and destination", "{{ .Source }} -> {{ .Destination }}", `C:\Data -> \\backup\share`},
+		{"status and exit code", "[{{ .Status }}] exit {{ .ExitCode }}", "[Failed] exit 8"},
+		{"severity", "{{ .Severity }} on {{ .Host }}", "failure on fileserver01"},
+		{"every field", "{{ .JobID }}: {{ .Status }} ({{ .ExitCode }}) {{ .Source }} to {{ .Destination }}", `nightly-42: Failed (8) C:\Data to \\backup\share`},
+		{"conditional", `{{ if ge .ExitCode 8 }}FAILED{{ else }}OK{{ end }}: {{ .Source }}`, `FAILED: C:\Data`},
+		{"flattened", "Robocopy\n  {{ .Status }}\t\r\n", "Robocopy Failed"},
+		{"empty field", "{{ .Timestamp }}", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SUBJECT_TEMPLATE", tt.template)
+			tmpl, err := loadSubjectTemplate()
+			if err != nil {
+				t.Fatalf("loadSubjectTemplate: %v", err)
+			}
+			got, err := renderSubject(tmpl, payload)
+			if err != nil {
+				t.Fatalf("renderSubject: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("subject = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubjectTemplateErrors(t *testing.T) {
+	t.Setenv("SUBJECT_TEMPLATE", "{{ .Status")
+	if _, err := loadSubjectTemplate(); err == nil || !strings.Contains(err.Error(), "SUBJECT_TEMPLATE") {
+		t.Errorf("err = %v, want an invalid SUBJECT_TEMPLATE error", err)
+	}
+
+	t.Setenv("SUBJECT_TEMPLATE", "{{ .NoSuchField }}")
+	tmpl, err := loadSubjectTemplate()
+	if err != nil {
+		t.Fatalf("loadSubjectTemplate: %v", err)
+	}
+	if _, err := renderSubject(tmpl, &WebhookPayload{}); err == nil {
+		t.Error("rendering an unknown field succeeded, want an error")
+	}
+
+	t.Setenv("SUBJECT_TEMPLATE", "")
+	if tmpl, err := loadSubjectTemplate(); tmpl != nil || err != nil {
+		t.Errorf("unset SUBJECT_TEMPLATE = %v, %v, want nil, nil", tmpl, err)
+	}
+}
+
+func TestExtractSubjectEmpty(t *testing.T) {
+	tests := []struct {
+		name           string
+		content        string
+		defaultSubject string
+		want           string
+	}{
+		{"empty subject line", "Subject: \r\nRobocopy output", "", defaultSubject},
+		{"bare subject line", "Subject:\nRobocopy output", "", defaultSubject},
+		{"whitespace subject line", "Subject: \t \r\nRobocopy output", "", defaultSubject},
+		{"configured default", "Subject: \r\nRobocopy output", "Backup report", "Backup report"},
+		{"no subject line", "Robocopy output", "Backup report", "Backup report"},
+		{"set subject", "Subject: Robocopy Failure Notification\r\nRobocopy output", "Backup report", "Robocopy Failure Notification"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DEFAULT_SUBJECT", tt.defaultSubject)
+			if got := extractSubject(tt.content); got != tt.want {
+				t.Errorf("subject = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// successFilter drops notifications of fully successful runs for teams that only want
+// to hear about failures. A nil *successFilter drops nothing.
+type successFilter struct {
+	maxExitCode int // Highest robocopy exit code still counted as success
+}
+
+// loadSuccessFilter enables the filter when SUPPRESS_SUCCESS is true. Exit codes up to
+// SUCCESS_MAX_EXIT_CODE count as success, defaulting to 3: files copied or extra files
+// found, but nothing mismatched or failed.
+func loadSuccessFilter() (*successFilter, error) {
+	if os.Getenv("SUPPRESS_SUCCESS") != "true" {
+		return nil, nil
+	}
+	f := &successFilter{maxExitCode: 3}
+	if v := os.Getenv("SUCCESS_MAX_EXIT_CODE"); v != "" {
+		code, err := strconv.Atoi(v)
+		if err != nil || code < 0 {
+			return nil, fmt.Errorf("invalid SUCCESS_MAX_EXIT_CODE %q: must be a non-negative integer", v)
+		}
+		f.maxExitCode = code
+	}
+	return f, nil
+}
+
+// suppressed reports whether payload describes a success that should not be emailed.
+// A status naming a warning or failure is never suppressed, whatever the exit code.
+func (f *successFilter) suppressed(payload *WebhookPayload) bool {
+	if f == nil {
+		return false
+	}
+	return payload.ExitCode <= f.maxExitCode && statusSeverity(payload.Status) == severitySuccess
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// optOutKeyword follows an address in the suppression file when the recipient only
+// opted out of non-critical notifications.
+const optOutKeyword = "noncritical"
+
+// suppressionList is a reloadable set of addresses that must never be emailed, such as
+// former employees or addresses that bounce. A nil list suppresses nothing.
+type suppressionList struct {
+	path    string
+	mu      sync.RWMutex
+	addrs   map[string]bool
+	optOuts map[string]bool // Still sent critical notifications
+}
+
+// loadSuppressionList reads the list from path, one address per line, optionally followed
+// by "noncritical" to suppress only non-critical notifications. Blank lines and lines
+// starting with # are ignored.
+func loadSuppressionList(path string) (*suppressionList, error) {
+	list := &suppressionList{path: path}
+	if err := list.reload(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// reload re-reads the list from disk, keeping the current entries if that fails.
+func (l *suppressionList) reload() error {
+	file, err := os.Open(l.path)
+	if err != nil {
+		return fmt.Errorf("opening suppression file: %w", err)
+	}
+	defer file.Close()
+
+	addrs, optOuts := make(map[string]bool), make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) > 1 && strings.EqualFold(fields[1], optOutKeyword) {
+			optOuts[strings.ToLower(fields[0])] = true
+			continue
+		}
+		addrs[strings.ToLower(fields[0])] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading suppression file: %w", err)
+	}
+
+	l.mu.Lock()
+	l.addrs, l.optOuts = addrs, optOuts
+	l.mu.Unlock()
+	log.Printf("Loaded %d suppressed addresses and %d opt-outs from %s", len(addrs), len(optOuts), l.path)
+	return nil
+}
+
+// optOut suppresses non-critical notifications to addr, appending it to the file so the
+// opt-out survives reloads and restarts.
+func (l *suppressionList) optOut(addr string) error {
+	addr = strings.ToLower(addr)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.addrs[addr] || l.optOuts[addr] {
+		return nil
+	}
+
+	file, err := os.OpenFile(l.path, os.O_RDWR|os.O_APPEND, 0)
+	if err != nil {
+		return fmt.Errorf("opening suppression file: %w", err)
+	}
+	defer file.Close()
+	// Don't join the new entry onto a last line without a newline
+	line := addr + " " + optOutKeyword + "\n"
+	if info, err := file.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := file.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			line = "\n" + line
+		}
+	}
+	if _, err := file.WriteString(line); err != nil {
+		return fmt.Errorf("writing suppression file: %w", err)
+	}
+
+	l.optOuts[addr] = true
+	log.Printf("%s opted out of non-critical notifications", addr)
+	return nil
+}
+
+// filter returns addrs without the suppressed addresses, logging each one dropped.
+// Critical notifications are still sent to addresses that only opted out.
+func (l *suppressionList) filter(addrs []string, critical bool) []string {
+	if l == nil {
+		return addrs
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	kept := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		key := strings.ToLower(addr)
+		if l.addrs[key] || !critical && l.optOuts[key] {
+			log.Printf("Suppressing email to %s", addr)
+			continue
+		}
+		kept = append(kept, addr)
+	}
+	return kept
+}
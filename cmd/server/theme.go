@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// defaultBannerColors are the banner colors used when HTML_COLOR_<SEVERITY> is unset.
+var defaultBannerColors = map[severity]string{
+	severitySuccess: "#2e7d32",
+	severityWarning: "#ef6c00",
+	severityFailure: "#c62828",
+	severityFatal:   "#7f0000",
+}
+
+// hexColor matches the #rgb and #rrggbb colors accepted for the banner.
+var hexColor = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// bannerTemplate renders the text body under a banner in the severity's color. Styles
+// are inline and the layout is a table, since many mail clients drop <style> blocks.
+var bannerTemplate = template.Must(template.New("banner").Parse(`<!DOCTYPE html>
+<html>
+<body style="margin:0;padding:0;background-color:#ffffff;">
+<table role="presentation" width="100%" cellpadding="0" cellspacing="0" border="0" style="border-collapse:collapse;font-family:Arial,Helvetica,sans-serif;">
+<tr><td style="background-color:{{.Color}};color:#ffffff;padding:12px 16px;font-size:18px;font-weight:bold;">{{.Label}}: {{.Subject}}</td></tr>
+<tr><td style="padding:16px;"><pre style="margin:0;font-family:Consolas,Menlo,monospace;font-size:13px;white-space:pre-wrap;color:#212121;">{{.Body}}</pre></td></tr>
+</table>
+</body>
+</html>
+`))
+
+// htmlTheme builds an HTML part with a color-coded severity banner for notifications
+// that don't bring their own HTML. A nil *htmlTheme builds nothing.
+type htmlTheme struct {
+	colors map[severity]string
+}
+
+// loadHTMLTheme enables the banner when HTML_BANNER is true, reading each severity's
+// color from HTML_COLOR_SUCCESS, HTML_COLOR_WARNING, HTML_COLOR_FAILURE and
+// HTML_COLOR_FATAL.
+func loadHTMLTheme() (*htmlTheme, error) {
+	if os.Getenv("HTML_BANNER") != "true" {
+		return nil, nil
+	}
+	theme := &htmlTheme{colors: make(map[severity]string)}
+	for _, sev := range severities {
+		name := "HTML_COLOR_" + strings.ToUpper(sev.String())
+		color := os.Getenv(name)
+		if color == "" {
+			color = defaultBannerColors[sev]
+		}
+		if !hexColor.MatchString(color) {
+			return nil, fmt.Errorf("invalid %s %q: must be a hex color such as #c62828", name, color)
+		}
+		theme.colors[sev] = color
+	}
+	return theme, nil
+}
+
+// render returns the HTML version of a notification of severity sev, or "" when the
+// theme is off.
+func (t *htmlTheme) render(sev severity, subject, body string) (string, error) {
+	if t == nil {
+		return "", nil
+	}
+	name := sev.String()
+	var b strings.Builder
+	err := bannerTemplate.Execute(&b, struct {
+		Color, Label, Subject, Body string
+	}{
+		Color:   t.colors[sev],
+		Label:   strings.ToUpper(name[:1]) + name[1:],
+		Subject: subject,
+		Body:    strings.TrimRight(strings.ReplaceAll(body, "\r\n", "\n"), "\n"),
+	})
+	if err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxThreadReferences caps the prior Message-IDs listed in References, so a long job
+// doesn't grow the header without bound. The thread root is always listed first.
+const maxThreadReferences = 20
+
+// jobThread is the messages sent so far for one job ID.
+type jobThread struct {
+	ids     []string
+	expires time.Time
+}
+
+// threadTracker remembers the Message-IDs sent per job ID so that later emails of a job
+// reply to the earlier ones and recipients' clients show them as one conversation.
+// A nil *threadTracker threads nothing.
+type threadTracker struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	threads map[string]*jobThread
+}
+
+// loadThreadTracker reads how long a job's thread is remembered from THREAD_TTL,
+// defaulting to 24h. A TTL of 0 disables threading.
+func loadThreadTracker() (*threadTracker, error) {
+	ttl := 24 * time.Hour
+	if v := os.Getenv("THREAD_TTL"); v != "" {
+		parsed, err := time.ParseDuration(v)
+		if err != nil || parsed < 0 {
+			return nil, fmt.Errorf("invalid THREAD_TTL %q: must be a non-negative duration", v)
+		}
+		ttl = parsed
+	}
+	if ttl == 0 {
+		return nil, nil
+	}
+	return &threadTracker{ttl: ttl, threads: make(map[string]*jobThread)}, nil
+}
+
+// threadRoot is the Message-ID every email of jobID refers back to. It is derived from
+// the job ID, so emails thread together even across restarts, but never sent itself.
+func threadRoot(jobID, from string) string {
+	sum := sha256.Sum256([]byte(jobID))
+	domain := from[strings.LastIndex(from, "@")+1:]
+	return "<job-" + hex.EncodeToString(sum[:12]) + "@" + domain + ">"
+}
+
+// headers returns the In-Reply-To and References values for the next email of jobID.
+func (t *threadTracker) headers(jobID, from string) (inReplyTo string, references []string) {
+	if t == nil || jobID == "" {
+		return "", nil
+	}
+	references = []string{threadRoot(jobID, from)}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.purgeExpired()
+	if thread, ok := t.threads[jobID]; ok {
+		references = append(references, thread.ids...)
+	}
+	return references[len(references)-1], references
+}
+
+// record adds a sent email to the thread of jobID.
+func (t *threadTracker) record(jobID, messageID string) {
+	if t == nil || jobID == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	thread, ok := t.threads[jobID]
+	if !ok {
+		thread = &jobThread{}
+		t.threads[jobID] = thread
+	}
+	thread.ids = append(thread.ids, messageID)
+	if len(thread.ids) > maxThreadReferences {
+		thread.ids = thread.ids[len(thread.ids)-maxThreadReferences:]
+	}
+	thread.expires = time.Now().Add(t.ttl)
+}
+
+// purgeExpired drops threads not added to within the TTL. Callers must hold t.mu.
+func (t *threadTracker) purgeExpired() {
+	now := time.Now()
+	for jobID, thread := range t.threads {
+		if now.After(thread.expires) {
+			delete(t.threads, jobID)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// loadTLSConfig builds the TLS settings used for STARTTLS from the environment. It returns
+// nil when the system defaults should be used.
+func loadTLSConfig() (*tls.Config, error) {
+	caFile := os.Getenv("SMTP_CA_FILE")
+	certFile := os.Getenv("SMTP_CLIENT_CERT_FILE")
+	keyFile := os.Getenv("SMTP_CLIENT_KEY_FILE")
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading SMTP_CA_FILE: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("SMTP_CA_FILE %s contains no valid PEM certificates", caFile)
+		}
+		config.RootCAs = pool
+	}
+
+	// Client certificates are for relays that require mutual TLS
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("SMTP_CLIENT_CERT_FILE and SMTP_CLIENT_KEY_FILE must be set together")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading SMTP client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
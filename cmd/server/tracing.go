@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of this service. It is a no-op until setupTracing installs an exporter.
+var tracer = otel.Tracer("github.com/masoncfrancis/emailSender")
+
+// tracingEnabled reports whether an OTLP endpoint is configured.
+func tracingEnabled() bool {
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// setupTracing exports spans over OTLP/HTTP when OTEL_EXPORTER_OTLP_ENDPOINT or
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is set; the exporter reads its other OTEL_* settings
+// itself. The returned function flushes pending spans and must be called before exiting.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	if !tracingEnabled() {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the default name
+	res, err := resource.Merge(
+		resource.NewSchemaless(semconv.ServiceName("emailSender")),
+		resource.Default(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// newTracingMiddleware starts a server span per request, continuing any trace context
+// sent by the caller, and makes it the parent of the spans started while handling it.
+func newTracingMiddleware() (fiber.Handler, error) {
+	if !tracingEnabled() {
+		return nil, nil
+	}
+	return func(c *fiber.Ctx) error {
+		ctx := otel.GetTextMapPropagator().Extract(c.UserContext(), fiberCarrier{c})
+		ctx, span := tracer.Start(ctx, c.Method()+" "+c.Route().Path,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.HTTPRequestMethodKey.String(c.Method()), semconv.HTTPRoute(c.Route().Path)),
+		)
+		defer span.End()
+		c.SetUserContext(ctx)
+
+		err := c.Next()
+		status := c.Response().StatusCode()
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if err != nil || status >= fiber.StatusInternalServerError {
+			span.SetStatus(codes.Error, "")
+		}
+		return err
+	}, nil
+}
+
+// fiberCarrier adapts request headers for trace context propagation.
+type fiberCarrier struct{ c *fiber.Ctx }
+
+func (f fiberCarrier) Get(key string) string { return f.c.Get(key) }
+func (f fiberCarrier) Set(key, value string) { f.c.Request().Header.Set(key, value) }
+func (f fiberCarrier) Keys() []string {
+	var keys []string
+	f.c.Request().Header.VisitAll(func(key, _ []byte) {
+		keys = append(keys, string(key))
+	})
+	return keys
+}
+
+// recordError marks span as failed with err.
+func recordError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
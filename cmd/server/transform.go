@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+)
+
+// transformFields lists the fields a rule may read and assign, with a zero value of
+// each field's type so expressions can be type-checked when the rules are loaded.
+var transformFields = map[string]any{
+	"Status":       "",
+	"Timestamp":    "",
+	"Source":       "",
+	"Destination":  "",
+	"ExitCode":     0,
+	"EmailContent": "",
+	"Host":         "",
+	"Subject":      "",
+}
+
+// transformRule assigns the result of an expr-lang expression to one notification field.
+type transformRule struct {
+	field   string
+	program *vm.Program
+}
+
+// loadTransformRules reads rules of the form `Field = expression`, one per line, from path.
+// Blank lines and lines starting with # are ignored. Every expression is compiled and
+// type-checked against its target field up front.
+func loadTransformRules(path string) ([]transformRule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening transform rules: %w", err)
+	}
+	defer file.Close()
+
+	var rules []transformRule
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		field, source, ok := strings.Cut(line, "=")
+		field = strings.TrimSpace(field)
+		if !ok || strings.TrimSpace(source) == "" {
+			return nil, fmt.Errorf("%s:%d: expected `Field = expression`", path, lineNo)
+		}
+		zero, known := transformFields[field]
+		if !known {
+			return nil, fmt.Errorf("%s:%d: unknown field %q", path, lineNo, field)
+		}
+
+		program, err := expr.Compile(source, expr.Env(transformFields), expr.AsKind(reflect.TypeOf(zero).Kind()))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+		rules = append(rules, transformRule{field: field, program: program})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading transform rules: %w", err)
+	}
+	return rules, nil
+}
+
+// applyTransforms runs rules in order against the payload and subject, each rule seeing
+// the results of the ones before it. It returns the possibly rewritten subject.
+func applyTransforms(rules []transformRule, payload *WebhookPayload, subject string) (string, error) {
+	if len(rules) == 0 {
+		return subject, nil
+	}
+
+	env := map[string]any{
+		"Status":       payload.Status,
+		"Timestamp":    payload.Timestamp,
+		"Source":       payload.Source,
+		"Destination":  payload.Destination,
+		"ExitCode":     payload.ExitCode,
+		"EmailContent": payload.EmailContent,
+		"Host":         payload.Host,
+		"Subject":      subject,
+	}
+	for _, rule := range rules {
+		result, err := expr.Run(rule.program, env)
+		if err != nil {
+			return "", fmt.Errorf("transforming %s: %w", rule.field, err)
+		}
+		env[rule.field] = result
+	}
+
+	payload.Status = env["Status"].(string)
+	payload.Timestamp = env["Timestamp"].(string)
+	payload.Source = env["Source"].(string)
+	payload.Destination = env["Destination"].(string)
+	payload.ExitCode = env["ExitCode"].(int)
+	payload.EmailContent = env["EmailContent"].(string)
+	payload.Host = env["Host"].(string)
+	return env["Subject"].(string), nil
+}
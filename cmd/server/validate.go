@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// validateHandler runs the checks a webhook payload goes through without rendering or
+// sending anything, so script authors can test their payloads in CI. Every failed check
+// is reported, not just the first.
+func (n *notifier) validateHandler(c *fiber.Ctx) error {
+	payload, err := parsePayload(c)
+	if errors.Is(err, errUnsupportedContentType) {
+		return respond(c, fiber.StatusUnsupportedMediaType, fiber.Map{
+			"valid":  false,
+			"errors": []string{"Content-Type must be application/json, application/x-www-form-urlencoded or multipart/form-data"},
+		})
+	}
+	if errors.Is(err, errAttachmentTooLarge) || errors.Is(err, errBodyTooLarge) {
+		return respond(c, fiber.StatusRequestEntityTooLarge, fiber.Map{
+			"valid":  false,
+			"errors": []string{err.Error()},
+		})
+	}
+	if errors.Is(err, errInvalidSignature) {
+		return respond(c, fiber.StatusUnauthorized, fiber.Map{
+			"valid":  false,
+			"errors": []string{"Invalid signature"},
+		})
+	}
+	if err != nil {
+		return respond(c, fiber.StatusBadRequest, fiber.Map{
+			"valid":  false,
+			"errors": []string{"Cannot parse request body: " + err.Error()},
+		})
+	}
+
+	var problems []string
+	for _, r := range []*result{checkBody(payload), n.freshness.check(payload), n.schedule.check(payload)} {
+		if r != nil {
+			problems = append(problems, r.body["error"].(string))
+		}
+	}
+	sev, to, r := n.route(payload)
+	if r != nil {
+		problems = append(problems, r.body["error"].(string))
+	}
+	if len(problems) > 0 {
+		return respond(c, fiber.StatusBadRequest, fiber.Map{
+			"valid":  false,
+			"errors": problems,
+		})
+	}
+
+	return respond(c, fiber.StatusOK, fiber.Map{
+		"valid":      true,
+		"severity":   sev.String(),
+		"from":       n.mail.identityFor(payload).From,
+		"recipients": to,
+	})
+}